@@ -1,18 +1,15 @@
 package autoclean
 
 import (
-	"context"
 	"errors"
 	"fmt"
 	"os"
-	"path/filepath"
+	"path"
 	"strconv"
 	"time"
-	"github.com/shirou/gopsutil/disk"
-	"regexp"
-	"glacier/config"
+	"glacier/keyindex"
 	"glacier/prometheus"
-	"github.com/gofrs/flock"
+	"glacier/shared"
 )
 
 
@@ -31,77 +28,68 @@ func getDiskUsageAllowed() float64 {
 
 var DiskUsageAllowed = getDiskUsageAllowed()
 
+// Stops listing the containers
+var errStop = errors.New("STOP")
 
-var ctx = context.Background()
+var current_data_time_window_function = func(name string) error {
+	if path.Ext(name) == ".tar" {
+		myDate, err := shared.GetContainerTime(name)
+		if err != nil {
+			fmt.Println("Error-current_data_time_window_function:", err)
+			return errStop
+		}
+		prometheus.Current_data_window_in_hours.Set(time.Since(myDate).Hours())
+		return errStop
+	}
 
-func ExtractDateFromFolder() *regexp.Regexp {
-        r, err := regexp.Compile("([0-9]{4}/[0-9]{2}/[0-9]{2}/[0-9]{2})")
-        if err != nil {
-                panic(err)
-        }
-        return r
+	return nil
 }
 
-var extractDateFromFolder = ExtractDateFromFolder()
-
-var current_data_time_window_function = func(pathX string, infoX os.DirEntry, errX error) error {
+// Hour folder whose manifest was reported last by autoclean
+var reportedFolder string
 
-	if errX != nil {
-		fmt.Printf("current_data_time_window_function: error 「%v」 at a path 「%q」\n", errX, pathX)
-		return errX
+// reportFolder prints the inventory of the hour folder before autoclean
+// removes or tiers its first container.
+func reportFolder(name string) {
+	folder, err := shared.HourFolder(name)
+	if err != nil || folder == reportedFolder {
+		return
 	}
-
-	if !infoX.IsDir() {
-		if filepath.Ext(pathX) == ".tar" {
-			myDate, err := time.Parse("2006/01/02/15", extractDateFromFolder.FindString(pathX))
-			if err != nil {
-				fmt.Println("Error-current_data_time_window_function:", err)
-				return errors.New("STOP")
-			}
-			prometheus.Current_data_window_in_hours.Set(time.Since(myDate).Hours())
-			return errors.New("STOP")
-		}
+	reportedFolder = folder
+	manifest, err := shared.LoadManifest(folder)
+	if err != nil {
+		fmt.Println("Manifest not readable:", folder, err)
+		return
 	}
-
-	return nil
+	fmt.Printf("AutoClean: %v Entries: %d StoredBytes: %d OriginalBytes: %d\r\n", folder, manifest.Entries, manifest.StoredBytes, manifest.OriginalBytes)
 }
 
-var autoCleanFunction = func(pathX string, infoX os.DirEntry, errX error) error {
-	usageStat, err := disk.UsageWithContext(ctx, config.Settings.Get(config.DATA_FOLDER))
+var autoCleanFunction = func(name string) error {
+	usageStat, err := shared.Containers.Usage(shared.CONTAINER_ROOT)
 	if err != nil {
 		fmt.Println("Panic! Disk usage not working err:", err)
-		return filepath.SkipDir
+		return errStop
 	}
 
 	if usageStat.UsedPercent < DiskUsageAllowed {
-		return filepath.SkipDir
-	}
-
-	if errX != nil {
-		fmt.Printf("autoCleanFunction: error 「%v」 at a path 「%q」\n", errX, pathX)
-		return errX
+		return errStop
 	}
 
-	if !infoX.IsDir() {
-		if filepath.Ext(pathX) == ".tar" {
-			fileLock := flock.New(pathX)
-			locked, err := fileLock.TryLockContext(ctx, 500*time.Millisecond)
-			if err != nil {
-				fmt.Println("lock timeout:", err)
-				return filepath.SkipDir
+	if path.Ext(name) == ".tar" {
+		reportFolder(name)
+		if shared.TieringEnabled() && shared.Sealed(name) {
+			// The whole container is moved to the tiering bucket instead of deleted
+			if err := shared.TierContainer(shared.BaseContainer(name)); err != nil {
+				fmt.Println("Tiering failed:", name, err)
+				return errStop
 			}
-			if !locked {
-				fmt.Println("file not locked:")
-				return filepath.SkipDir
-			}
-			defer fileLock.Unlock()
-
-			err = os.Remove(pathX)
-			fmt.Printf("AutoDelete: %v DeleteWhen: %v<%v\r\n", pathX, usageStat.UsedPercent, DiskUsageAllowed)
-			if err != nil {
-				fmt.Println("Remove file error: ", err)
-			}
-
+			fmt.Printf("AutoTier: %v DeleteWhen: %v<%v\r\n", name, usageStat.UsedPercent, DiskUsageAllowed)
+			return nil
+		}
+		err = shared.RemoveSegment(name)
+		fmt.Printf("AutoDelete: %v DeleteWhen: %v<%v\r\n", name, usageStat.UsedPercent, DiskUsageAllowed)
+		if err != nil {
+			fmt.Println("Remove file error: ", err)
 		}
 	}
 
@@ -111,9 +99,9 @@ var autoCleanFunction = func(pathX string, infoX os.DirEntry, errX error) error
 func AutoClean() {
 	fmt.Println("AutoClean start")
 	for {
-		filepath.WalkDir(config.Settings.Get(config.DATA_FOLDER), current_data_time_window_function)
+		shared.Containers.List(shared.CONTAINER_ROOT, current_data_time_window_function)
 		time.Sleep(10000 * time.Millisecond)
-		usageStat, err := disk.UsageWithContext(ctx, config.Settings.Get(config.DATA_FOLDER))
+		usageStat, err := shared.Containers.Usage(shared.CONTAINER_ROOT)
 		if err != nil {
 			fmt.Println("Panic! Disk usage not working err:", err)
 		}
@@ -121,14 +109,54 @@ func AutoClean() {
 		if usageStat.UsedPercent > DiskUsageAllowed {
 			fmt.Println("Start autoClean:", usageStat.UsedPercent)
 			fmt.Printf("Start AutoClean DeleteWhen: %v<%v\r\n", usageStat.UsedPercent, DiskUsageAllowed)
-			err := filepath.WalkDir(config.Settings.Get(config.DATA_FOLDER), autoCleanFunction)
+			err := shared.Containers.List(shared.CONTAINER_ROOT, autoCleanFunction)
 
-			if err != nil {
-				fmt.Printf("error walking the path %q: %v\n", config.Settings.Get(config.DATA_FOLDER), err)
+			if err != nil && err != errStop {
+				fmt.Printf("error listing the path %q: %v\n", shared.CONTAINER_ROOT, err)
 			}
+			pruneKeys()
 		}
 
 	}
 
 }
 
+// pruneKeys removes the S3 keys of removed containers from the key index.
+func pruneKeys() {
+	if !keyindex.Enabled() {
+		return
+	}
+	exists := make(map[string]bool)
+	count, err := keyindex.Prune(func(uuid string) bool {
+		containerFile, _, err := shared.GetContainerFile(uuid)
+		if err != nil {
+			return false
+		}
+		if _, ok := exists[containerFile]; !ok {
+			exists[containerFile] = shared.ContainerExists(uuid)
+		}
+		return exists[containerFile]
+	})
+	if err != nil {
+		fmt.Println("Key index prune failed:", err)
+	}
+	if count > 0 {
+		fmt.Printf("AutoClean: pruned %d keys\r\n", count)
+	}
+}
+
+// ReportInventory exposes the totals of the hour manifests as metrics.
+func ReportInventory() {
+	for {
+		inventory, folders, err := shared.TotalInventory(shared.CONTAINER_ROOT)
+		if err != nil {
+			fmt.Println("Inventory not readable:", err)
+		} else {
+			prometheus.InventoryEntries.Set(float64(inventory.Entries))
+			prometheus.InventoryStoredBytes.Set(float64(inventory.StoredBytes))
+			prometheus.InventoryOriginalBytes.Set(float64(inventory.OriginalBytes))
+			fmt.Printf("Inventory: %d hours Entries: %d StoredBytes: %d\r\n", folders, inventory.Entries, inventory.StoredBytes)
+		}
+		time.Sleep(600000 * time.Millisecond)
+	}
+}
@@ -0,0 +1,19 @@
+package compact
+
+import (
+	"fmt"
+	"glacier/shared"
+	"time"
+)
+
+// Compactor removes deleted blobs from disk by rewriting containers flagged with a compact marker.
+func Compactor() {
+	fmt.Println("Compactor start")
+	for {
+		err := shared.CompactPending(shared.CONTAINER_ROOT)
+		if err != nil {
+			fmt.Printf("error listing the path %q: %v\n", shared.CONTAINER_ROOT, err)
+		}
+		time.Sleep(60000 * time.Millisecond)
+	}
+}
@@ -32,6 +32,20 @@ func (s *SettingsType) Set(id string, description string, defaultValue string) {
 	}
 }
 
+// Override sets the value of id and returns a func restoring the previous
+// value, e.g. for t.Cleanup in tests.
+func (s *SettingsType) Override(id string, value string) func() {
+	old, ok := s.m[id]
+	s.m[id] = SettingType{Description: old.Description, Value: value}
+	return func() {
+		if ok {
+			s.m[id] = old
+		} else {
+			delete(s.m, id)
+		}
+	}
+}
+
 
 const (
 	ACME_SERVER   = "ACME_SERVER"
@@ -42,6 +56,44 @@ const (
 	SERVER_PORT = "SERVER_PORT"
 	READ_TOKEN = "READ_TOKEN"
 	WRITE_TOKEN = "WRITE_TOKEN"
+	DUPLICATE_POLICY = "DUPLICATE_POLICY"
+	THUMBNAIL_SUPPORT = "THUMBNAIL_SUPPORT"
+	THUMBNAIL_SIZE = "THUMBNAIL_SIZE"
+	THUMBNAIL_MAX_PIXELS = "THUMBNAIL_MAX_PIXELS"
+	GENERATED_UUID_VERSION = "GENERATED_UUID_VERSION"
+	KEY_INDEX_SUPPORT = "KEY_INDEX_SUPPORT"
+	LAYOUT_TIMEZONE = "LAYOUT_TIMEZONE"
+	CONTAINER_SHARDS = "CONTAINER_SHARDS"
+	FOLDER_MINUTES = "FOLDER_MINUTES"
+	MAX_CONTAINER_SIZE = "MAX_CONTAINER_SIZE"
+	WRITE_QUEUE_SIZE = "WRITE_QUEUE_SIZE"
+	FILE_CACHE_SIZE = "FILE_CACHE_SIZE"
+	BLOB_CACHE_SIZE = "BLOB_CACHE_SIZE"
+	BLOB_CACHE_MAX_BLOB = "BLOB_CACHE_MAX_BLOB"
+	REPLICATION_PEERS = "REPLICATION_PEERS"
+	REPLICATION_TOKEN = "REPLICATION_TOKEN"
+	REPLICATION_TIMEOUT = "REPLICATION_TIMEOUT"
+	REPLICATION_PEER_TOKEN = "REPLICATION_PEER_TOKEN"
+	READ_FALLBACK_PEERS = "READ_FALLBACK_PEERS"
+	READ_FALLBACK_TOKEN = "READ_FALLBACK_TOKEN"
+	READ_FALLBACK_REPAIR = "READ_FALLBACK_REPAIR"
+	READ_FALLBACK_TIMEOUT = "READ_FALLBACK_TIMEOUT"
+	TIERING_ENDPOINT = "TIERING_ENDPOINT"
+	TIERING_BUCKET = "TIERING_BUCKET"
+	TIERING_ACCESS_KEY = "TIERING_ACCESS_KEY"
+	TIERING_SECRET_KEY = "TIERING_SECRET_KEY"
+	TIERING_REGION = "TIERING_REGION"
+	TIERING_SSL = "TIERING_SSL"
+	CONTAINER_BACKEND = "CONTAINER_BACKEND"
+	STORAGE_BACKEND = "STORAGE_BACKEND"
+	STORAGE_LOCAL_ROOT = "STORAGE_LOCAL_ROOT"
+	TIERING_AGE = "TIERING_AGE"
+	SWIFT_AUTH_URL = "SWIFT_AUTH_URL"
+	SWIFT_USER = "SWIFT_USER"
+	SWIFT_KEY = "SWIFT_KEY"
+	SWIFT_CONTAINER = "SWIFT_CONTAINER"
+	SEAL_SUPPORT = "SEAL_SUPPORT"
+	SEAL_COMPRESSION = "SEAL_COMPRESSION"
 )
 
 func (s *SettingsType) Init() {
@@ -53,6 +105,44 @@ func (s *SettingsType) Init() {
 	s.Set(SERVER_PORT, "server tcp port","8000")
 	s.Set(READ_TOKEN, "Read TOKEN [;]","")
 	s.Set(WRITE_TOKEN, "Write TOKEN [;]","")
+	s.Set(DUPLICATE_POLICY, "Writing an existing UUID [first|reject|last|version]","first")
+	s.Set(THUMBNAIL_SUPPORT, "Generate thumbnail variant for PNG/JPEG/GIF uploads","false")
+	s.Set(THUMBNAIL_SIZE, "Thumbnail max width/height in pixels","128")
+	s.Set(THUMBNAIL_MAX_PIXELS, "Skip thumbnails of images with more pixels","50000000")
+	s.Set(GENERATED_UUID_VERSION, "UUID version generated for uploads without id [v1|v4|v7]","v4")
+	s.Set(KEY_INDEX_SUPPORT, "Accept S3 object keys that are not Time-UUID","false")
+	s.Set(LAYOUT_TIMEZONE, "Timezone of time-UUIDs and YYYY/MM/DD/HH folders","UTC")
+	s.Set(CONTAINER_SHARDS, "Tar archives per folder [16|256|4096]","256")
+	s.Set(FOLDER_MINUTES, "Minutes per folder [60|30|20|15|10|5...]","60")
+	s.Set(MAX_CONTAINER_SIZE, "Max MB per tar archive before rolling over to xx.1.tar (0 = unlimited)","0")
+	s.Set(WRITE_QUEUE_SIZE, "Queued writes per tar archive before uploads wait","64")
+	s.Set(FILE_CACHE_SIZE, "Open tar archive handles kept for reuse","512")
+	s.Set(BLOB_CACHE_SIZE, "MB of decompressed blobs cached in memory (0 = disabled)","64")
+	s.Set(BLOB_CACHE_MAX_BLOB, "Max KB of a blob kept in the blob cache","256")
+	s.Set(REPLICATION_PEERS, "Peer Glacier URLs receiving every write and delete [;]","")
+	s.Set(REPLICATION_TOKEN, "Write TOKEN of the replication peers","")
+	s.Set(REPLICATION_TIMEOUT, "Seconds a replicated write or delete may take","300")
+	s.Set(REPLICATION_PEER_TOKEN, "Token peers send with replicated writes and deletes, which are not replicated again","")
+	s.Set(READ_FALLBACK_PEERS, "Peer Glacier URLs asked for blobs missing locally [;]","")
+	s.Set(READ_FALLBACK_TOKEN, "Read TOKEN of the fallback peers","")
+	s.Set(READ_FALLBACK_REPAIR, "Store blobs fetched from a fallback peer locally again","false")
+	s.Set(READ_FALLBACK_TIMEOUT, "Seconds a fetch from a fallback peer may take","300")
+	s.Set(TIERING_ENDPOINT, "S3 endpoint (host:port) receiving sealed tar archives before autoclean deletes them","")
+	s.Set(TIERING_BUCKET, "S3 bucket of tiered tar archives","glacier")
+	s.Set(TIERING_ACCESS_KEY, "S3 access key of the tiering endpoint","")
+	s.Set(TIERING_SECRET_KEY, "S3 secret key of the tiering endpoint","")
+	s.Set(TIERING_REGION, "S3 region of the tiering endpoint","us-east-1")
+	s.Set(TIERING_SSL, "Use HTTPS for the tiering endpoint","true")
+	s.Set(CONTAINER_BACKEND, "Store of the tar archives uploads are written to [local|swift]","local")
+	s.Set(STORAGE_BACKEND, "Store of sealed tar archives [local|s3|swift], s3 when TIERING_ENDPOINT is set","")
+	s.Set(STORAGE_LOCAL_ROOT, "Folder receiving sealed tar archives of the local store, kept in place when empty","")
+	s.Set(TIERING_AGE, "Hours after their folder time sealed tar archives are tiered, only when autoclean needs space when empty","")
+	s.Set(SWIFT_AUTH_URL, "Swift v1 auth URL","")
+	s.Set(SWIFT_USER, "Swift user (account:user)","")
+	s.Set(SWIFT_KEY, "Swift key","")
+	s.Set(SWIFT_CONTAINER, "Swift container of sealed tar archives","glacier")
+	s.Set(SEAL_SUPPORT, "Sort and index tar archives of folders whose time is over","false")
+	s.Set(SEAL_COMPRESSION, "Recompress gzip blobs when sealing [|zstd]","")
 
 	table := tablewriter.NewWriter(os.Stdout)
 	table.SetAutoWrapText(false)
@@ -4,11 +4,16 @@ import (
 	"archive/tar"
 	"encoding/json"
 	"fmt"
+	"glacier/config"
 	"glacier/shared"
+	"html"
 	"io"
 	"net/http"
-	"os"
+	"net/url"
 	"path"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -40,6 +45,18 @@ func Uuidv1hello(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+func Uuidv7hello(w http.ResponseWriter, req *http.Request) {
+	uuidv7, _ := shared.NewUUIDv7()
+	idString := uuidv7.String()
+	containerFile, idString, _ := shared.GetContainerFile(idString)
+	myuuid := &MyUUID{Uuid: idString, ContainerFile: containerFile}
+	jData, err := json.Marshal(myuuid)
+	if err == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jData)
+	}
+}
+
 func Redirect(w http.ResponseWriter, r *http.Request) {
 	id := r.URL.Query().Get("file")
 	if id != "" {
@@ -53,12 +70,18 @@ func Redirect(w http.ResponseWriter, r *http.Request) {
 func FileView(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		count := 0
-		fileExt := path.Ext(r.URL.String())
+		fileExt := path.Ext(r.URL.Path)
 		if fileExt != ".tar" {
 			next.ServeHTTP(w, r)
 			return
 		}
-		tarFile, err := os.Open("." + r.URL.String())
+		name, ok := containerPath(r.URL.Path)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintln(w, "File not found")
+			return
+		}
+		tarFile, err := shared.Containers.Reader(name)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			fmt.Fprintln(w, "open tar file failed", err)
@@ -66,17 +89,9 @@ func FileView(next http.Handler) http.Handler {
 		}
 		defer tarFile.Close()
 
-		tr := tar.NewReader(tarFile)
-		fmt.Fprintf(w, "<html><head><link href=../../../../../static/bootstrap.css rel=stylesheet></head>")
-		fmt.Fprintf(w, "<table class=\"table table-hover\">")
-		fmt.Fprintf(w, "<tr><th>ID</th><th>Name</th>")
-		fmt.Fprintf(w, "<th>GzipSize</th>")
-		fmt.Fprintf(w, "<th>RealSize</th>")
-		fmt.Fprintf(w, "<th>GzipRatio</th>")
-		fmt.Fprintf(w, "<th>Filename</th>")
-		fmt.Fprintf(w, "<th>MimeType</th>")
-		fmt.Fprintf(w, "<th>Compressed</th>")
-		fmt.Fprintf(w, "<th>Metadata</th><tr>")
+		tr := tar.NewReader(io.NewSectionReader(tarFile, 0, tarFile.Size()))
+		var headers []*tar.Header
+		thumbnails := make(map[string]bool)
 		for {
 			hdr, err := tr.Next()
 			if err == io.EOF {
@@ -87,18 +102,152 @@ func FileView(next http.Handler) http.Handler {
 				fmt.Fprintln(w, "open tar file failed", err)
 				break
 			}
+			headers = append(headers, hdr)
+			if hdr.PAXRecords[shared.PAX_TOMBSTONE] == "true" {
+				delete(thumbnails, hdr.Name)
+			} else if hdr.PAXRecords[shared.PAX_VARIANT] == shared.THUMBNAIL_VARIANT {
+				thumbnails[hdr.Name] = true
+			}
+		}
+		fmt.Fprintf(w, "<html><head><link href=../../../../../static/bootstrap.css rel=stylesheet></head>")
+		if len(thumbnails) > 0 {
+			fmt.Fprintf(w, "<div class=\"d-flex flex-wrap\">")
+			for _, hdr := range headers {
+				if _, isVariant := hdr.PAXRecords[shared.PAX_VARIANT]; isVariant || !thumbnails[hdr.Name] {
+					continue
+				}
+				fmt.Fprintf(w, "<a href=..\\..\\..\\..\\..\\get\\%v><img class=\"img-thumbnail m-1\" src=..\\..\\..\\..\\..\\get\\%v?variant=%v title=%v></a>", hdr.Name, hdr.Name, shared.THUMBNAIL_VARIANT, hdr.Name)
+				delete(thumbnails, hdr.Name)
+			}
+			fmt.Fprintf(w, "</div>")
+		}
+		fmt.Fprintf(w, "<table class=\"table table-hover\">")
+		fmt.Fprintf(w, "<tr><th>ID</th><th>Name</th>")
+		fmt.Fprintf(w, "<th>GzipSize</th>")
+		fmt.Fprintf(w, "<th>RealSize</th>")
+		fmt.Fprintf(w, "<th>GzipRatio</th>")
+		fmt.Fprintf(w, "<th>Filename</th>")
+		fmt.Fprintf(w, "<th>MimeType</th>")
+		fmt.Fprintf(w, "<th>Compressed</th>")
+		fmt.Fprintf(w, "<th>Variant</th>")
+		fmt.Fprintf(w, "<th>Version</th>")
+		fmt.Fprintf(w, "<th>Metadata</th><tr>")
+		for _, hdr := range headers {
 			metadata, _ := json.Marshal(hdr.PAXRecords)
 			fmt.Fprintf(w, "<tr><td>%d</td>", count)
 			fmt.Fprintf(w, "<td><a href=..\\..\\..\\..\\..\\get\\%v>%v</a></td>", hdr.Name, hdr.Name)
 			fmt.Fprintf(w, "<td>%d</td>", hdr.Size)
 			fmt.Fprintf(w, "<td>%d</td>", hdr.Uid)
 			fmt.Fprintf(w, "<td>%.2f</td>", (float64)((float64)(hdr.Size)/(float64)(hdr.Uid)))
-			fmt.Fprintf(w, "<td>%v</td>", hdr.Uname)
-			fmt.Fprintf(w, "<td>%v</td>", hdr.Gname)
+			fmt.Fprintf(w, "<td>%v</td>", html.EscapeString(hdr.Uname))
+			fmt.Fprintf(w, "<td>%v</td>", html.EscapeString(hdr.Gname))
 			fmt.Fprintf(w, "<td>%v</td>", hdr.Mode)
-			fmt.Fprintf(w, "<td>%v</td><tr>", string(metadata))
+			if variant, ok := hdr.PAXRecords[shared.PAX_VARIANT]; ok {
+				fmt.Fprintf(w, "<td><a href=..\\..\\..\\..\\..\\get\\%v?variant=%v>%v</a></td>", hdr.Name, url.QueryEscape(variant), html.EscapeString(variant))
+			} else {
+				fmt.Fprintf(w, "<td>original</td>")
+			}
+			if versionId, ok := hdr.PAXRecords[shared.PAX_VERSION_ID]; ok {
+				fmt.Fprintf(w, "<td><a href=..\\..\\..\\..\\..\\get\\%v?versionId=%v>%v</a> <a href=..\\..\\..\\..\\..\\get\\%v?versions>all</a></td>", hdr.Name, url.QueryEscape(versionId), html.EscapeString(versionId), hdr.Name)
+			} else {
+				fmt.Fprintf(w, "<td></td>")
+			}
+			fmt.Fprintf(w, "<td>%v</td><tr>", html.EscapeString(string(metadata)))
 			count = count + 1
 		}
 		fmt.Fprintf(w, "</table>")
 	})
 }
+
+// containerPath returns the name of the stored container or folder of a
+// /files/ URL path.
+func containerPath(urlPath string) (string, bool) {
+	name := strings.Trim(path.Clean(urlPath), "/")
+	return name, name == shared.CONTAINER_ROOT || strings.HasPrefix(name, shared.CONTAINER_ROOT+"/")
+}
+
+// FolderView lists the folders and containers below a /files/ folder and
+// serves the other stored files, e.g. manifest.json and .idx, raw. Files
+// outside the store, e.g. layout.json and the tiering catalogs, are served
+// from DATA_FOLDER.
+func FolderView() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		folder, ok := containerPath(r.URL.Path)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintln(w, "File not found")
+			return
+		}
+		var children []string
+		seen := make(map[string]bool)
+		err := shared.Containers.List(folder, func(name string) error {
+			if !strings.HasPrefix(name, folder+"/") {
+				return nil
+			}
+			parts := strings.SplitN(strings.TrimPrefix(name, folder+"/"), "/", 2)
+			child := parts[0]
+			if len(parts) > 1 {
+				child += "/"
+			}
+			if !seen[child] {
+				seen[child] = true
+				children = append(children, child)
+			}
+			return nil
+		})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintln(w, "list folder failed", err)
+			return
+		}
+		if len(children) == 0 {
+			serveFile(w, r, folder)
+			return
+		}
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			http.Redirect(w, r, path.Base(r.URL.Path)+"/", http.StatusMovedPermanently)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, "<pre>\n")
+		writeInventory(w, folder)
+		for _, child := range children {
+			fmt.Fprintf(w, "<a href=\"%v\">%v</a>\n", (&url.URL{Path: child}).String(), html.EscapeString(child))
+		}
+		fmt.Fprintf(w, "</pre>\n")
+	})
+}
+
+// serveFile writes the stored file name, or the file of the /files/ URL
+// path in DATA_FOLDER when the store does not hold it. Folders have no
+// extension, an empty folder is not opened as a file.
+func serveFile(w http.ResponseWriter, r *http.Request, name string) {
+	if path.Ext(name) != "" && !strings.HasSuffix(r.URL.Path, "/") {
+		if reader, err := shared.Containers.Reader(name); err == nil {
+			defer reader.Close()
+			http.ServeContent(w, r, path.Base(name), time.Time{}, io.NewSectionReader(reader, 0, reader.Size()))
+			return
+		}
+	}
+	dataFolder := http.FileServer(http.Dir(config.Settings.Get(config.DATA_FOLDER)))
+	http.StripPrefix("/"+shared.CONTAINER_ROOT+"/", dataFolder).ServeHTTP(w, r)
+}
+
+// writeInventory writes the totals of the hour manifests below folder.
+func writeInventory(w io.Writer, folder string) {
+	inventory, folders, err := shared.TotalInventory(folder)
+	if err != nil || folders == 0 {
+		return
+	}
+	fmt.Fprintf(w, "Entries: %d StoredBytes: %d OriginalBytes: %d\n", inventory.Entries, inventory.StoredBytes, inventory.OriginalBytes)
+	fmt.Fprintf(w, "UUIDs: %v - %v\n", inventory.MinUUID, inventory.MaxUUID)
+	mimeTypes := make([]string, 0, len(inventory.MimeTypes))
+	for mimeType := range inventory.MimeTypes {
+		mimeTypes = append(mimeTypes, mimeType)
+	}
+	sort.Strings(mimeTypes)
+	for _, mimeType := range mimeTypes {
+		fmt.Fprintf(w, "%v: %d\n", html.EscapeString(mimeType), inventory.MimeTypes[mimeType])
+	}
+	fmt.Fprintf(w, "\n")
+}
@@ -0,0 +1,284 @@
+package keyindex
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"glacier/config"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Record maps an object key to the time-UUID its content is stored under.
+type Record struct {
+	Key     string
+	UUID    string
+	Size    int64
+	Time    time.Time
+	Deleted bool `json:",omitempty"`
+}
+
+var (
+	mutex sync.RWMutex
+	keys  = make(map[string]Record)
+	uuids = make(map[string]string) // UUID -> key
+)
+
+func indexFolder() string {
+	return filepath.Join(config.Settings.Get(config.DATA_FOLDER), "keyindex")
+}
+
+// bucketFile returns the index file for the hour of t, so the index is split the same way as the data.
+func bucketFile(t time.Time) string {
+	return filepath.Join(indexFolder(), t.UTC().Format("2006/01/02/15")+".jsonl")
+}
+
+func Enabled() bool {
+	return config.Settings.Get(config.KEY_INDEX_SUPPORT) == "true"
+}
+
+// Load reads every index bucket into memory, later records replacing earlier ones.
+func Load() error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	keys = make(map[string]Record)
+	uuids = make(map[string]string)
+	buckets, err := bucketFiles()
+	if err != nil {
+		return err
+	}
+	for _, bucket := range buckets {
+		records, err := readBucket(bucket)
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			apply(record)
+		}
+	}
+	return nil
+}
+
+// bucketFiles returns the index buckets, oldest first.
+func bucketFiles() ([]string, error) {
+	var buckets []string
+	err := filepath.WalkDir(indexFolder(), func(pathX string, infoX os.DirEntry, errX error) error {
+		if errX != nil {
+			if os.IsNotExist(errX) {
+				return filepath.SkipDir
+			}
+			return errX
+		}
+		if !infoX.IsDir() && filepath.Ext(pathX) == ".jsonl" {
+			buckets = append(buckets, pathX)
+		}
+		return nil
+	})
+	sort.Strings(buckets)
+	return buckets, err
+}
+
+func readBucket(bucket string) ([]Record, error) {
+	f, err := os.Open(bucket)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var records []Record
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			fmt.Println("keyindex: skipping broken record in", bucket, err)
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+func apply(record Record) {
+	if previous, ok := keys[record.Key]; ok && uuids[previous.UUID] == record.Key {
+		delete(uuids, previous.UUID)
+	}
+	if record.Deleted {
+		delete(keys, record.Key)
+	} else {
+		keys[record.Key] = record
+		uuids[record.UUID] = record.Key
+	}
+}
+
+func store(record Record) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return storeLocked(record)
+}
+
+func storeLocked(record Record) error {
+	bucket := bucketFile(record.Time)
+	// Deletes go to the bucket of the record they delete, next to the data of the key
+	if record.Deleted {
+		previous, ok := keys[record.Key]
+		if !ok {
+			return nil
+		}
+		bucket = bucketFile(previous.Time)
+	}
+	if err := os.MkdirAll(filepath.Dir(bucket), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(bucket, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	apply(record)
+	return nil
+}
+
+// Add records that key is stored under uuid.
+func Add(key string, uuid string, size int64) error {
+	return store(Record{Key: key, UUID: uuid, Size: size, Time: time.Now()})
+}
+
+// Delete removes key from the index.
+func Delete(key string) error {
+	return store(Record{Key: key, Time: time.Now(), Deleted: true})
+}
+
+// RemoveUUIDs removes the keys stored under the UUIDs, e.g. when autoclean
+// deleted their container.
+func RemoveUUIDs(ids []string) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, id := range ids {
+		key, ok := uuids[id]
+		if !ok {
+			continue
+		}
+		if err := storeLocked(Record{Key: key, Time: time.Now(), Deleted: true}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Prune removes the keys whose UUID is no longer stored, compacts the index
+// and returns the number of keys removed.
+func Prune(stored func(uuid string) bool) (int, error) {
+	mutex.RLock()
+	ids := make([]string, 0, len(uuids))
+	for id := range uuids {
+		ids = append(ids, id)
+	}
+	mutex.RUnlock()
+	var gone []string
+	for _, id := range ids {
+		if !stored(id) {
+			gone = append(gone, id)
+		}
+	}
+	if err := RemoveUUIDs(gone); err != nil {
+		return 0, err
+	}
+	return len(gone), compact()
+}
+
+// compact rewrites the buckets holding deleted or replaced records with the
+// current records only, and removes buckets left empty. Buckets are compacted
+// oldest first, so a crash never brings back a record replaced or deleted in a
+// later bucket.
+func compact() error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	buckets, err := bucketFiles()
+	if err != nil {
+		return err
+	}
+	for _, bucket := range buckets {
+		if err := compactBucket(bucket); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func compactBucket(bucket string) error {
+	records, err := readBucket(bucket)
+	if err != nil {
+		return err
+	}
+	var lines []byte
+	kept := 0
+	for _, record := range records {
+		current, ok := keys[record.Key]
+		if record.Deleted || !ok || current.UUID != record.UUID || !current.Time.Equal(record.Time) {
+			continue
+		}
+		line, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		lines = append(append(lines, line...), '\n')
+		kept++
+	}
+	if kept == len(records) {
+		return nil
+	}
+	if kept == 0 {
+		return os.Remove(bucket)
+	}
+	tmp := bucket + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(lines); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, bucket)
+}
+
+func Lookup(key string) (Record, bool) {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	record, ok := keys[key]
+	return record, ok
+}
+
+// List returns the records with keys starting with prefix, sorted by key.
+func List(prefix string) []Record {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	var records []Record
+	for key, record := range keys {
+		if strings.HasPrefix(key, prefix) {
+			records = append(records, record)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Key < records[j].Key })
+	return records
+}
@@ -0,0 +1,54 @@
+package keyindex
+
+import (
+	"glacier/config"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrune(t *testing.T) {
+	t.Cleanup(config.Settings.Override(config.DATA_FOLDER, t.TempDir()))
+	if err := Load(); err != nil {
+		t.Fatalf("Load error:%v", err)
+	}
+	old := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	for _, record := range []Record{{Key: "old", UUID: "uuid-old", Time: old}, {Key: "gone", UUID: "uuid-gone", Time: old}} {
+		if err := store(record); err != nil {
+			t.Fatalf("Store error:%v", err)
+		}
+	}
+	if err := Add("new", "uuid-new", 3); err != nil {
+		t.Fatalf("Add error:%v", err)
+	}
+
+	// The delete goes to the bucket of the deleted record, not the current hour
+	if err := Delete("old"); err != nil {
+		t.Fatalf("Delete error:%v", err)
+	}
+	content, err := ioutil.ReadFile(bucketFile(old))
+	if err != nil || strings.Count(string(content), "\n") != 3 {
+		t.Fatalf("Delete not in bucket of the key! Have:\"%v\" Error:%v", string(content), err)
+	}
+
+	count, err := Prune(func(uuid string) bool { return uuid != "uuid-gone" })
+	if err != nil || count != 1 {
+		t.Fatalf("Prune Have:%v Error:%v", count, err)
+	}
+	if _, err := os.Stat(bucketFile(old)); !os.IsNotExist(err) {
+		t.Fatalf("Bucket without keys not removed! Error:%v", err)
+	}
+	if err := Load(); err != nil {
+		t.Fatalf("Load error:%v", err)
+	}
+	if _, ok := Lookup("new"); !ok {
+		t.Fatalf("Key lost by compaction")
+	}
+	for _, key := range []string{"old", "gone"} {
+		if _, ok := Lookup(key); ok {
+			t.Fatalf("Key %v back after compaction", key)
+		}
+	}
+}
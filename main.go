@@ -3,17 +3,25 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"glacier/autoclean"
+	"glacier/compact"
 	"glacier/config"
 	"glacier/gui"
+	"glacier/keyindex"
 	"glacier/prometheus"
+	"glacier/replication"
 	"glacier/s3"
+	"glacier/seal"
 	"glacier/shared"
+	"glacier/store"
 	"io/ioutil"
 	"log"
+	"mime/multipart"
 	"net/http"
 	"os"
+	"strings"
 
 	"github.com/caddyserver/certmagic"
 	"github.com/gabriel-vasile/mimetype"
@@ -26,13 +34,9 @@ var ctx = context.Background()
 func rawUpload(w http.ResponseWriter, r *http.Request) {
 	prometheus.RawUploadProcessed.Inc()
 	vars := mux.Vars(r)
-	id, ok := vars["id"]
-	if !ok {
-		fmt.Println("id is missing in parameters")
-	}
 	token, ok := vars["token"]
 	if !ok {
-		fmt.Println("token is missing in parameters")
+		token = r.URL.Query().Get("token")
 	}
 	fmt.Println(token)
 	if config.Settings.Has(config.WRITE_TOKEN) && token != config.Settings.Get(config.WRITE_TOKEN) {
@@ -40,6 +44,17 @@ func rawUpload(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintln(w, "Access forbidden")
 		return
 	}
+	id, ok := vars["id"]
+	generated := !ok
+	if generated {
+		newId, err := shared.GenerateUUID(r.URL.Query().Get("uuid"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, err)
+			return
+		}
+		id = newId
+	}
 	fileBytes, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -47,18 +62,53 @@ func rawUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer r.Body.Close()
-	id, containerFile, err := shared.SharedUpload(r, token, id, fileBytes)
+	result, err := shared.SharedUpload(r, token, id, fileBytes)
+	if generated {
+		// Clients without UUID logic learn the id from Location and the JSON body
+		if err == nil {
+			w.Header().Set("Location", "/get/"+result.UUID)
+			result.Status = http.StatusCreated
+		}
+		writeJSON(w, result.Status, result)
+		return
+	}
+	if wantsJSON(r) {
+		writeJSON(w, result.Status, result)
+		return
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(result.Status)
 		fmt.Fprintln(w, err)
+		return
 	}
 	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "<html><a href=get/%v>%v</a> <br><a href=%v>%v</a>", id, id, containerFile, containerFile)
+	fmt.Fprintf(w, "<html><a href=get/%v>%v</a> <br><a href=%v>%v</a>", result.UUID, result.UUID, result.ContainerFile, result.ContainerFile)
+}
+
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	jData, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(jData)
 }
 
 func uploadFile(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
-	r.ParseMultipartForm(10 << 30)
+	err := r.ParseMultipartForm(10 << 30)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err)
+		return
+	}
 	tokenList := r.MultipartForm.Value["token"]
 	token := ""
 	if len(tokenList) > 0 {
@@ -67,49 +117,58 @@ func uploadFile(w http.ResponseWriter, r *http.Request) {
 	fmt.Println(token)
 
 	files := r.MultipartForm.File["file"]
-	savedList := make(map[string]string)
+	results := make([]shared.UploadResult, 0, len(files))
+	failed := 0
 	for _, fileHeader := range files {
-
-		//file, handler, err := r.FormFile("file")
-		file, err := fileHeader.Open()
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintln(w, "Error Retrieving the File")
-			fmt.Fprintln(w, err)
-			fmt.Println("Error Retrieving the File", err)
-			return
-		}
-		defer file.Close()
-
 		fileUUID := fileHeader.Filename
 		generateNewUUID := r.URL.Query().Get("newuuid")
 		if generateNewUUID != "" {
 			fileUUID = shared.GenerateTimeUUID()
 		}
-		fileBytes, err := ioutil.ReadAll(file)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintln(w, err)
-			return
-		}
-		id, containerFile, err := shared.SharedUpload(r, token, fileUUID, fileBytes)
-		savedList[id] = containerFile
+
+		//file, handler, err := r.FormFile("file")
+		result, err := uploadPart(r, token, fileUUID, fileHeader)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintln(w, err)
-			return
+			fmt.Println("Upload failed", fileUUID, err)
+			failed++
 		}
+		results = append(results, result)
 	}
-	if len(savedList) > 0 {
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, "<html><table border=1><tr><th>UUID</th><th>TAR File</th></tr>")
-		for key, value := range savedList {
-			fmt.Fprintf(w, "<tr><td><a href=get/%v>%v</a></td><td><a href=%v>%v</a></td></tr>", key, key, value, value)
+
+	// 207 Multi-Status when only some of the files failed
+	status := http.StatusOK
+	if failed > 0 && failed < len(results) {
+		status = http.StatusMultiStatus
+	} else if failed > 0 {
+		status = results[0].Status
+	}
+	if wantsJSON(r) {
+		writeJSON(w, status, results)
+		return
+	}
+	if len(results) > 0 {
+		w.WriteHeader(status)
+		fmt.Fprintf(w, "<html><table border=1><tr><th>UUID</th><th>TAR File</th><th>Status</th></tr>")
+		for _, result := range results {
+			fmt.Fprintf(w, "<tr><td><a href=get/%v>%v</a></td><td><a href=%v>%v</a></td><td>%d %v</td></tr>", result.UUID, result.UUID, result.ContainerFile, result.ContainerFile, result.Status, result.Error)
 		}
 		fmt.Fprintf(w, "</table>")
 	}
 }
 
+func uploadPart(r *http.Request, token string, fileUUID string, fileHeader *multipart.FileHeader) (shared.UploadResult, error) {
+	file, err := fileHeader.Open()
+	if err != nil {
+		return shared.UploadResult{UUID: fileUUID, Status: http.StatusInternalServerError, Error: "Error Retrieving the File: " + err.Error()}, err
+	}
+	defer file.Close()
+	fileBytes, err := ioutil.ReadAll(file)
+	if err != nil {
+		return shared.UploadResult{UUID: fileUUID, Status: http.StatusInternalServerError, Error: err.Error()}, err
+	}
+	return shared.SharedUpload(r, token, fileUUID, fileBytes)
+}
+
 func InitServer() *mux.Router {
 	config.Settings.Init()
 	pcapDetector := func(raw []byte, limit uint32) bool {
@@ -126,9 +185,19 @@ func InitServer() *mux.Router {
 		fmt.Println(err)
 		log.Fatal("Panic unable to create folder:", config.Settings.Get(config.DATA_FOLDER))
 	}
+	if err := shared.LoadLayout(); err != nil {
+		log.Fatal("Panic unable to load layout:", err)
+	}
+	if keyindex.Enabled() {
+		if err := keyindex.Load(); err != nil {
+			log.Fatal("Panic unable to load key index:", err)
+		}
+	}
+	if replication.Enabled() {
+		replication.Init()
+	}
 	r := mux.NewRouter()
-	filesfs := http.StripPrefix("/files/", http.FileServer(http.Dir(config.Settings.Get(config.DATA_FOLDER))))
-	r.PathPrefix("/files/").Handler(gui.FileView(filesfs))
+	r.PathPrefix("/files/").Handler(gui.FileView(gui.FolderView()))
 	staticfs := http.StripPrefix("/static/", http.FileServer(http.Dir("/static")))
 	r.PathPrefix("/static/").Handler(staticfs)
 
@@ -147,23 +216,88 @@ func InitServer() *mux.Router {
 
 	r.HandleFunc("/uuid", gui.Uuidhello)
 	r.HandleFunc("/uuidv1", gui.Uuidv1hello)
+	r.HandleFunc("/uuidv7", gui.Uuidv7hello)
+	r.HandleFunc("/data", s3.S3Post).Methods("POST")
 	r.HandleFunc("/data/", s3.S3Bucket)
 	r.HandleFunc("/upload", uploadFile)
+	r.HandleFunc("/rawupload", rawUpload).Methods("POST", "PUT")
 	r.HandleFunc("/rawupload/{id}", rawUpload)
 	r.HandleFunc("/rawupload/{token}/{id}", rawUpload)
+	r.HandleFunc("/get/{id}", shared.DeleteFile).Methods("DELETE")
+	r.HandleFunc("/get/{token}/{id}", shared.DeleteFile).Methods("DELETE")
 	r.HandleFunc("/get/{id}", shared.GetFile)
 	r.HandleFunc("/get/{token}/{id}", shared.GetFile)
+	r.HandleFunc("/batch", shared.BatchGet).Methods("POST")
+	r.HandleFunc("/batch/{token}", shared.BatchGet).Methods("POST")
+	r.HandleFunc("/api/list", shared.ListBlobs)
+	r.HandleFunc("/api/{token}/list", shared.ListBlobs)
+	r.HandleFunc("/keyindex", s3.ReplicateKey).Methods("POST")
 	r.HandleFunc("/redirect", gui.Redirect)
-	r.HandleFunc("/data/{id}", s3.S3Put)
+	r.HandleFunc("/data/{id:.+}", s3.S3Put)
 	r.HandleFunc("/{token}/{id}", s3.S3Put)
 	r.Handle("/metrics", promhttp.Handler())
 	return r
 }
 
+// initContainers routes uploads, reads and autoclean to the store of CONTAINER_BACKEND.
+func initContainers() {
+	containers, err := store.New()
+	if err != nil {
+		log.Fatal("Panic unable to open the container store:", err)
+	}
+	shared.Containers = containers
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate-layout" {
+		config.Settings.Init()
+		initContainers()
+		unlock, err := shared.LockDataFolder(true)
+		if err != nil {
+			log.Fatal("Stop the server before migrate-layout:", err)
+		}
+		defer unlock()
+		if err := shared.LoadLayout(); err != nil {
+			log.Fatal("Panic unable to load layout:", err)
+		}
+		if err := shared.MigrateLayout(); err != nil {
+			log.Fatal("Migrate failed:", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "rebuild-manifests" {
+		config.Settings.Init()
+		initContainers()
+		unlock, err := shared.LockDataFolder(true)
+		if err != nil {
+			log.Fatal("Stop the server before rebuild-manifests:", err)
+		}
+		defer unlock()
+		if err := shared.LoadLayout(); err != nil {
+			log.Fatal("Panic unable to load layout:", err)
+		}
+		if err := shared.RebuildManifests(); err != nil {
+			log.Fatal("Rebuild failed:", err)
+		}
+		return
+	}
 	r := InitServer()
+	initContainers()
+	unlock, err := shared.LockDataFolder(false)
+	if err != nil {
+		log.Fatal("Panic unable to lock data folder:", err)
+	}
+	defer unlock()
 	go autoclean.AutoClean()
+	go autoclean.ReportInventory()
+	go compact.Compactor()
 	go prometheus.SystemStat()
+	if replication.Enabled() {
+		go replication.Replicator()
+	}
+	if _, tiering := shared.TieringAge(); shared.SealEnabled() || tiering {
+		go seal.Sealer()
+	}
 
 	if config.Settings.Has(config.SERVER_DOMAIN) && config.Settings.Has(config.ACME_SERVER) {
 		certmagic.DefaultACME.Agreed = true
@@ -3,18 +3,38 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"glacier/shared"
+	"glacier/store"
 	"io"
 	"io/ioutil"
 	"log"
 	"mime/multipart"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
 )
 
+func waitForServer(t *testing.T, addr string) {
+	for i := 0; i < 50; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("Server %v did not start", addr)
+}
+
 func TestS3(t *testing.T) {
 	endpoint := "localhost"
 	accessKeyID := "aaaaaaaaaaaaaaaaaaaa"
@@ -24,6 +44,7 @@ func TestS3(t *testing.T) {
 
 	r := InitServer()
 	go http.ListenAndServe(":80", r)
+	waitForServer(t, "localhost:80")
 
 	// Initialize minio client object.
 	server, err := minio.New(endpoint, &minio.Options{
@@ -54,6 +75,14 @@ func TestS3(t *testing.T) {
 		t.Fatalf("Upload/download did not pass! Want:\"%v\" Have:\"%v\"", string(data), string(outputData))
 	}
 
+	err = server.RemoveObject(context.Background(), "data", test_uuid, minio.RemoveObjectOptions{})
+	if err != nil {
+		t.Fatalf("Unable to RemoveObject Error:%v", err)
+	}
+	_, err = server.StatObject(context.Background(), "data", test_uuid, minio.StatObjectOptions{})
+	if err == nil {
+		t.Fatalf("Object still available after RemoveObject")
+	}
 }
 
 func TestServer(t *testing.T) {
@@ -61,6 +90,7 @@ func TestServer(t *testing.T) {
 	data := []byte("this is some data stored as a byte slice in Go Lang!")
 	r := InitServer()
 	go http.ListenAndServe(":8000", r)
+	waitForServer(t, "localhost:8000")
 
 	bodyBuf := &bytes.Buffer{}
 	bodyWriter := multipart.NewWriter(bodyBuf)
@@ -98,3 +128,125 @@ func TestServer(t *testing.T) {
 		t.Fatalf("Upload/download did not pass! Want:\"%v\" Have:\"%v\"", string(data), string(getbody))
 	}
 }
+
+func TestFiles(t *testing.T) {
+	dataFolder := t.TempDir()
+	os.Setenv("DATA_FOLDER", dataFolder)
+	defer os.Unsetenv("DATA_FOLDER")
+	containers := shared.Containers
+	shared.Containers = store.NewMemory(1 << 30)
+	defer func() { shared.Containers = containers }()
+	server := httptest.NewServer(InitServer())
+	defer server.Close()
+
+	test_uuid := "20200102-0000-" + shared.GenerateTimeUUID()[14:]
+	if _, err := shared.UploadVariant("", test_uuid, "", []byte("listed "+test_uuid)); err != nil {
+		t.Fatalf("Upload failed! Error:%v", err)
+	}
+	if err := shared.FlushManifests(); err != nil {
+		t.Fatalf("Manifest not written! Error:%v", err)
+	}
+	if err := ioutil.WriteFile(dataFolder+"/layout.json", []byte("[]"), 0600); err != nil {
+		t.Fatalf("Layout not written! Error:%v", err)
+	}
+	containerFile, _, _ := shared.GetContainerFile(test_uuid)
+	folder := path.Dir(containerFile)
+
+	files := []struct {
+		path string
+		want string
+	}{
+		{folder + "/", "Entries: 1 "},
+		{folder + "/", path.Base(containerFile)},
+		{containerFile, test_uuid},
+		{folder + "/" + shared.MANIFEST_FILE, "\"Entries\""},
+		{shared.CONTAINER_ROOT + "/layout.json", "[]"},
+	}
+	for _, file := range files {
+		resp, err := http.Get(server.URL + "/" + file.path)
+		if err != nil {
+			t.Fatalf("Unable to get %v! Error:%v", file.path, err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), file.want) {
+			t.Errorf("Wrong %v! Have:\"%v\" \"%v\"", file.path, resp.Status, string(body))
+		}
+	}
+	resp, err := http.Get(server.URL + "/" + folder + "/missing.json")
+	if err != nil {
+		t.Fatalf("Unable to get file! Error:%v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Missing file found! Have:%v", resp.Status)
+	}
+}
+
+func TestJSONUpload(t *testing.T) {
+	test_uuid := shared.GenerateTimeUUID()
+	data := []byte("this is some data stored as a byte slice in Go Lang!")
+	server := httptest.NewServer(InitServer())
+	defer server.Close()
+
+	bodyBuf := &bytes.Buffer{}
+	bodyWriter := multipart.NewWriter(bodyBuf)
+	fileWriter, _ := bodyWriter.CreateFormFile("file", test_uuid)
+	fileWriter.Write(data)
+	bodyWriter.CreateFormFile("file", "not-a-uuid")
+	bodyWriter.Close()
+
+	req, _ := http.NewRequest("POST", server.URL+"/upload", bodyBuf)
+	req.Header.Set("Content-Type", bodyWriter.FormDataContentType())
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Panic unable to upload file")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		t.Fatalf("Wrong response-code! Have:\"%v\"", resp.Status)
+	}
+	var results []shared.UploadResult
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		t.Fatalf("Unable to decode upload results! Error:%v", err)
+	}
+	if len(results) != 2 || results[0].Status != http.StatusOK || results[1].Status != http.StatusBadRequest {
+		t.Fatalf("Wrong upload results! Have:%+v", results)
+	}
+	if results[0].UUID != test_uuid || results[0].Size != int64(len(data)) || results[0].Checksum == "" {
+		t.Fatalf("Wrong upload result! Have:%+v", results[0])
+	}
+}
+
+func TestGeneratedUUID(t *testing.T) {
+	server := httptest.NewServer(InitServer())
+	defer server.Close()
+
+	for _, upload := range []string{"/rawupload", "/rawupload?uuid=v1", "/rawupload?uuid=v7", "/data"} {
+		data := "generated uuid " + upload
+		resp, err := http.Post(server.URL+upload, "application/octet-stream", bytes.NewReader([]byte(data)))
+		if err != nil {
+			t.Fatalf("Panic unable to upload file")
+		}
+		var result shared.UploadResult
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Upload %v failed! Have:\"%v\" Error:%v", upload, resp.Status, err)
+		}
+		if resp.Header.Get("Location") == "" || result.UUID == "" {
+			t.Fatalf("Generated UUID not returned for %v! Have:%+v", upload, result)
+		}
+
+		getresp, err := http.Get(server.URL + "/get/" + result.UUID)
+		if err != nil {
+			t.Fatalf("Unable to get file! Error:%v", err)
+		}
+		getbody, _ := ioutil.ReadAll(getresp.Body)
+		getresp.Body.Close()
+		if string(getbody) != data {
+			t.Fatalf("Upload/download did not pass! Want:\"%v\" Have:\"%v\"", data, string(getbody))
+		}
+	}
+}
@@ -34,6 +34,102 @@ var (
 		Name: "current_data_window_in_hours",
 		Help: "Current data time-windows in hours",
 	})
+	DeleteProcessed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "delete_processed_total",
+		Help: "The total number of blobs deleted by tombstone",
+	})
+	CompactedContainers = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "compacted_containers_total",
+		Help: "The total number of containers rewritten without deleted blobs",
+	})
+	WriteQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "write_queue_depth",
+		Help: "The number of writes waiting for their container writer",
+	})
+	WriteBatches = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "write_batches_total",
+		Help: "The total number of write batches committed with one lock and fsync",
+	})
+	FileCacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "file_cache_hits_total",
+		Help: "The total number of tar archive opens served by a cached handle",
+	})
+	FileCacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "file_cache_misses_total",
+		Help: "The total number of tar archive opens not in the handle cache",
+	})
+	FileCacheEvictions = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "file_cache_evictions_total",
+		Help: "The total number of cached tar archive handles closed to bound the cache",
+	})
+	FileCacheOpen = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "file_cache_open",
+		Help: "The number of tar archive handles held by the handle cache",
+	})
+	BlobCacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "blob_cache_hits_total",
+		Help: "The total number of blob reads served from the blob cache",
+	})
+	BlobCacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "blob_cache_misses_total",
+		Help: "The total number of blob reads not in the blob cache",
+	})
+	BlobCacheEvictions = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "blob_cache_evictions_total",
+		Help: "The total number of blobs dropped to bound the blob cache",
+	})
+	BlobCacheBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "blob_cache_bytes",
+		Help: "The number of decompressed bytes held by the blob cache",
+	})
+	FallbackReads = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "fallback_reads_total",
+		Help: "The total number of blobs missing locally served by a peer",
+	})
+	FallbackRepairs = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "fallback_repairs_total",
+		Help: "The total number of blobs fetched from a peer and stored locally again",
+	})
+	TieredContainers = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tiered_containers_total",
+		Help: "The total number of containers moved to the tiering bucket",
+	})
+	TieredReads = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tiered_reads_total",
+		Help: "The total number of range requests to tiered containers",
+	})
+	SealedContainers = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sealed_containers_total",
+		Help: "The total number of containers sorted and indexed by the sealing job",
+	})
+	SealedLookups = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sealed_lookups_total",
+		Help: "The total number of blob lookups answered by the index of a sealed container",
+	})
+	InventoryEntries = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "inventory_entries",
+		Help: "The number of blobs and variants recorded by the hour manifests",
+	})
+	InventoryStoredBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "inventory_stored_bytes",
+		Help: "The stored bytes of the blobs recorded by the hour manifests",
+	})
+	InventoryOriginalBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "inventory_original_bytes",
+		Help: "The uncompressed bytes of the blobs recorded by the hour manifests",
+	})
+	ReplicationLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "replication_lag_seconds",
+		Help: "Age of the replication log record shipped last, 0 when the peer is caught up",
+	}, []string{"peer"})
+	ReplicationShipped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "replication_shipped_total",
+		Help: "The total number of writes and deletes shipped to the peer",
+	}, []string{"peer"})
+	ReplicationErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "replication_errors_total",
+		Help: "The total number of failed replication attempts to the peer",
+	}, []string{"peer"})
 )
 
 var ctx = context.Background()
@@ -0,0 +1,394 @@
+package replication
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"glacier/config"
+	"glacier/keyindex"
+	"glacier/prometheus"
+	"glacier/shared"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Record of the replication log, one per committed write or delete.
+type Record struct {
+	shared.Commit
+	Time time.Time
+}
+
+// Position of a peer in the replication log.
+type Position struct {
+	File    string // Log file relative to the log folder, empty before the first file
+	Offset  int64  // Bytes of File shipped
+	CatchUp bool   `json:",omitempty"` // Existing containers are copied before the log
+	Copied  string `json:",omitempty"` // Last container copied by the catch-up
+}
+
+var logMutex sync.Mutex
+
+func Enabled() bool {
+	return config.Settings.Has(config.REPLICATION_PEERS)
+}
+
+// peers returns the base URLs of the peer Glacier servers.
+func peers() []string {
+	var peers []string
+	for _, peer := range strings.Split(config.Settings.Get(config.REPLICATION_PEERS), ";") {
+		if peer = strings.TrimRight(strings.TrimSpace(peer), "/"); peer != "" {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// peerClient returns the client shipping to the peers, a stalled peer fails
+// after REPLICATION_TIMEOUT and is retried.
+func peerClient() *http.Client {
+	timeout, err := strconv.Atoi(config.Settings.Get(config.REPLICATION_TIMEOUT))
+	if err != nil || timeout < 1 {
+		timeout = 300
+	}
+	return &http.Client{Timeout: time.Duration(timeout) * time.Second}
+}
+
+func logFolder() string {
+	return filepath.Join(config.Settings.Get(config.DATA_FOLDER), "replication", "log")
+}
+
+func positionFile(peer string) string {
+	return filepath.Join(config.Settings.Get(config.DATA_FOLDER), "replication", "peers", url.QueryEscape(peer)+".json")
+}
+
+// Init records every commit in the replication log.
+func Init() {
+	shared.OnCommit = func(commit shared.Commit) {
+		if err := appendLog(Record{Commit: commit, Time: time.Now()}); err != nil {
+			fmt.Println("replication log failed:", commit.UUID, err)
+		}
+	}
+}
+
+// appendLog writes the record to the log file of its hour.
+func appendLog(record Record) error {
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	logFile := filepath.Join(logFolder(), record.Time.UTC().Format("2006/01/02/15")+".jsonl")
+	if err := os.MkdirAll(filepath.Dir(logFile), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(logFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// logFiles returns the log files relative to the log folder, oldest first.
+func logFiles() ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(logFolder(), func(pathX string, infoX os.DirEntry, errX error) error {
+		if errX != nil {
+			if os.IsNotExist(errX) {
+				return filepath.SkipDir
+			}
+			return errX
+		}
+		if !infoX.IsDir() && filepath.Ext(pathX) == ".jsonl" {
+			rel, err := filepath.Rel(logFolder(), pathX)
+			if err != nil {
+				return err
+			}
+			files = append(files, rel)
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files, err
+}
+
+func loadPosition(peer string) (Position, error) {
+	var pos Position
+	data, err := ioutil.ReadFile(positionFile(peer))
+	if err != nil {
+		return pos, err
+	}
+	err = json.Unmarshal(data, &pos)
+	return pos, err
+}
+
+func savePosition(peer string, pos Position) error {
+	file := positionFile(peer)
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(pos)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(file+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+// Replicator ships the replication log to every peer.
+func Replicator() {
+	fmt.Println("Replicator start")
+	for _, peer := range peers() {
+		go func(peer string) {
+			for {
+				if err := syncPeer(peer); err != nil {
+					fmt.Println("replication failed:", peer, err)
+					prometheus.ReplicationErrors.WithLabelValues(peer).Inc()
+					time.Sleep(10 * time.Second)
+					continue
+				}
+				trimLog()
+				time.Sleep(time.Second)
+			}
+		}(peer)
+	}
+}
+
+// syncPeer ships the log records the peer has not received yet. A peer
+// without position is a fresh replica, it gets every stored blob first and
+// then the log written since it was added.
+func syncPeer(peer string) error {
+	pos, err := loadPosition(peer)
+	if os.IsNotExist(err) {
+		if pos, err = endOfLog(); err != nil {
+			return err
+		}
+		pos.CatchUp = true
+		err = savePosition(peer, pos)
+	}
+	if err != nil {
+		return err
+	}
+	if pos.CatchUp {
+		if err := catchUp(peer, &pos); err != nil {
+			return err
+		}
+	}
+	return shipLog(peer, &pos)
+}
+
+func endOfLog() (Position, error) {
+	files, err := logFiles()
+	if err != nil || len(files) == 0 {
+		return Position{}, err
+	}
+	last := files[len(files)-1]
+	fi, err := os.Stat(filepath.Join(logFolder(), last))
+	if err != nil {
+		return Position{}, err
+	}
+	return Position{File: last, Offset: fi.Size()}, nil
+}
+
+// catchUp copies every container to the peer, continuing after the last copied
+// one, and then the key index.
+func catchUp(peer string, pos *Position) error {
+	fmt.Println("Replication catch-up start:", peer)
+	var containers []string
+	err := shared.Containers.List(shared.CONTAINER_ROOT, func(name string) error {
+		if path.Ext(name) != ".tar" {
+			return nil
+		}
+		containerFile := shared.BaseContainer(name)
+		if containerFile > pos.Copied && (len(containers) == 0 || containers[len(containers)-1] != containerFile) {
+			containers = append(containers, containerFile)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(containers)
+	for _, containerFile := range containers {
+		commits, err := shared.ContainerCommits(containerFile)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, commit := range commits {
+			if err := ship(peer, commit); err != nil {
+				return err
+			}
+		}
+		pos.Copied = containerFile
+		if err := savePosition(peer, *pos); err != nil {
+			return err
+		}
+	}
+	// Keys are shipped after the blobs they map to
+	if keyindex.Enabled() {
+		for _, record := range keyindex.List("") {
+			if err := ship(peer, shared.Commit{Op: shared.COMMIT_KEY, UUID: record.UUID, Key: record.Key, Size: record.Size}); err != nil {
+				return err
+			}
+		}
+	}
+	pos.CatchUp = false
+	pos.Copied = ""
+	fmt.Println("Replication catch-up done:", peer)
+	return savePosition(peer, *pos)
+}
+
+// shipLog ships the complete records after pos up to the end of the log.
+func shipLog(peer string, pos *Position) error {
+	files, err := logFiles()
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if file < pos.File {
+			continue
+		}
+		if file != pos.File {
+			*pos = Position{File: file}
+		}
+		if err := shipFile(peer, pos); err != nil {
+			return err
+		}
+	}
+	prometheus.ReplicationLag.WithLabelValues(peer).Set(0)
+	return nil
+}
+
+func shipFile(peer string, pos *Position) error {
+	f, err := os.Open(filepath.Join(logFolder(), pos.File))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Seek(pos.Offset, io.SeekStart); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// A partial line is still being written
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var record Record
+		if err := json.Unmarshal(line, &record); err != nil {
+			fmt.Println("replication: skipping broken record in", pos.File, err)
+		} else {
+			prometheus.ReplicationLag.WithLabelValues(peer).Set(time.Since(record.Time).Seconds())
+			if err := ship(peer, record.Commit); err != nil {
+				return err
+			}
+		}
+		pos.Offset += int64(len(line))
+		if err := savePosition(peer, *pos); err != nil {
+			return err
+		}
+	}
+}
+
+// ship sends the commit to the peer through its upload and delete API.
+func ship(peer string, commit shared.Commit) error {
+	tokenPath := ""
+	if config.Settings.Has(config.REPLICATION_TOKEN) {
+		tokenPath = url.PathEscape(config.Settings.Get(config.REPLICATION_TOKEN)) + "/"
+	}
+	var req *http.Request
+	var err error
+	switch commit.Op {
+	case shared.COMMIT_PUT:
+		data, _, readErr := shared.ReadBlob(commit.UUID, commit.Variant, commit.VersionId)
+		if readErr == shared.ErrNotFound || os.IsNotExist(readErr) {
+			// Deleted or aged out since, a later record or the catch-up has the current state
+			return nil
+		}
+		if readErr != nil {
+			return readErr
+		}
+		target := peer + "/rawupload/" + tokenPath + commit.UUID
+		if commit.Variant != "" {
+			target += "?variant=" + url.QueryEscape(commit.Variant)
+		}
+		req, err = http.NewRequest("POST", target, bytes.NewReader(data))
+	case shared.COMMIT_DELETE:
+		req, err = http.NewRequest("DELETE", peer+"/get/"+tokenPath+commit.UUID, nil)
+	case shared.COMMIT_KEY, shared.COMMIT_KEY_DELETE:
+		body, marshalErr := json.Marshal(commit)
+		if marshalErr != nil {
+			return marshalErr
+		}
+		req, err = http.NewRequest("POST", peer+"/keyindex", bytes.NewReader(body))
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if config.Settings.Has(config.REPLICATION_PEER_TOKEN) {
+		req.Header.Set(shared.REPLICATED_HEADER, config.Settings.Get(config.REPLICATION_PEER_TOKEN))
+	}
+	resp, err := peerClient().Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	// Missing and duplicate blobs mean the peer already has the current state
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotFound && resp.StatusCode != http.StatusConflict {
+		return fmt.Errorf("%v %v: %v", req.Method, commit.UUID, resp.Status)
+	}
+	prometheus.ReplicationShipped.WithLabelValues(peer).Inc()
+	return nil
+}
+
+// trimLog removes the log files every peer has shipped.
+func trimLog() {
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	oldest := ""
+	for i, peer := range peers() {
+		pos, err := loadPosition(peer)
+		if err != nil {
+			return
+		}
+		if i == 0 || pos.File < oldest {
+			oldest = pos.File
+		}
+	}
+	files, err := logFiles()
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		if file >= oldest {
+			break
+		}
+		if err := os.Remove(filepath.Join(logFolder(), file)); err != nil {
+			fmt.Println("replication log trim failed:", file, err)
+		}
+	}
+}
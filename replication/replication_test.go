@@ -0,0 +1,98 @@
+package replication
+
+import (
+	"glacier/config"
+	"glacier/keyindex"
+	"glacier/shared"
+	"glacier/store"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	config.Settings.Init()
+	os.Exit(m.Run())
+}
+
+func TestReplication(t *testing.T) {
+	var mutex sync.Mutex
+	var received []string
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mutex.Lock()
+		received = append(received, r.Method+" "+r.URL.String()+" "+string(body))
+		if r.Header.Get(shared.REPLICATED_HEADER) != "peer-token" {
+			t.Errorf("Request shipped without %v: %v", shared.REPLICATED_HEADER, r.URL)
+		}
+		mutex.Unlock()
+	}))
+	defer peer.Close()
+
+	containers := shared.Containers
+	shared.Containers = store.NewMemory(1 << 30)
+	t.Cleanup(func() {
+		shared.FlushManifests()
+		shared.Containers = containers
+	})
+	t.Cleanup(config.Settings.Override(config.DATA_FOLDER, t.TempDir()))
+	t.Cleanup(config.Settings.Override(config.REPLICATION_PEERS, peer.URL))
+	t.Cleanup(config.Settings.Override(config.REPLICATION_PEER_TOKEN, "peer-token"))
+	t.Cleanup(config.Settings.Override(config.KEY_INDEX_SUPPORT, "true"))
+	if err := keyindex.Load(); err != nil {
+		t.Fatalf("Unable to load key index! Error:%v", err)
+	}
+	Init()
+	defer func() { shared.OnCommit = nil }()
+
+	first := shared.GenerateTimeUUID()
+	second := shared.GenerateTimeUUID()
+	if _, err := shared.UploadVariant("", first, "", []byte("first")); err != nil {
+		t.Fatalf("Upload failed! Error:%v", err)
+	}
+	if err := keyindex.Add("sensor/first", first, 5); err != nil {
+		t.Fatalf("Key index failed! Error:%v", err)
+	}
+	// A fresh replica copies the stored blobs
+	if err := syncPeer(peer.URL); err != nil {
+		t.Fatalf("Catch-up failed! Error:%v", err)
+	}
+	if _, err := shared.UploadVariant("", second, "", []byte("second")); err != nil {
+		t.Fatalf("Upload failed! Error:%v", err)
+	}
+	shared.CommitKey("sensor/second", second, 6, false)
+	if err := shared.DeleteBlob("", first); err != nil {
+		t.Fatalf("Delete failed! Error:%v", err)
+	}
+	if err := syncPeer(peer.URL); err != nil {
+		t.Fatalf("Replication failed! Error:%v", err)
+	}
+
+	want := []string{
+		"POST /rawupload/" + first + " first",
+		"POST /keyindex {\"Op\":\"key\",\"UUID\":\"" + first + "\",\"Key\":\"sensor/first\",\"Size\":5}",
+		"POST /rawupload/" + second + " second",
+		"POST /keyindex {\"Op\":\"key\",\"UUID\":\"" + second + "\",\"Key\":\"sensor/second\",\"Size\":6}",
+		"DELETE /get/" + first + " ",
+	}
+	if len(received) != len(want) {
+		t.Fatalf("Wrong requests shipped! Want:%v Have:%v", want, received)
+	}
+	for i := range want {
+		if received[i] != want[i] {
+			t.Errorf("Wrong request shipped! Want:%v Have:%v", want[i], received[i])
+		}
+	}
+
+	// The position survives a restart
+	pos, err := loadPosition(peer.URL)
+	if err != nil || pos.CatchUp {
+		t.Fatalf("Position not saved! Have:%+v Error:%v", pos, err)
+	}
+	if err := syncPeer(peer.URL); err != nil || len(received) != len(want) {
+		t.Errorf("Records shipped twice! Have:%v Error:%v", received, err)
+	}
+}
@@ -3,13 +3,17 @@ package s3
 import (
 	"crypto/md5"
 	"encoding/hex"
+	"encoding/json"
 	"encoding/xml"
 	"fmt"
 	"glacier/config"
+	"glacier/keyindex"
 	"glacier/prometheus"
 	"glacier/shared"
 	"io/ioutil"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -30,7 +34,208 @@ func xmlEncoder(w http.ResponseWriter) *xml.Encoder {
 	return xe
 }
 
+type ObjectIdentifier struct {
+	Key string `xml:"Key"`
+}
+
+type Delete struct {
+	XMLName xml.Name           `xml:"Delete"`
+	Quiet   bool               `xml:"Quiet"`
+	Objects []ObjectIdentifier `xml:"Object"`
+}
+
+type DeleteError struct {
+	Key     string `xml:"Key"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+type DeleteResult struct {
+	XMLName xml.Name           `xml:"DeleteResult"`
+	Xmlns   string             `xml:"xmlns,attr"`
+	Deleted []ObjectIdentifier `xml:"Deleted"`
+	Errors  []DeleteError      `xml:"Error"`
+}
+
+type Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type ListBucketResult struct {
+	XMLName               xml.Name       `xml:"ListBucketResult"`
+	Xmlns                 string         `xml:"xmlns,attr"`
+	Name                  string         `xml:"Name"`
+	Prefix                string         `xml:"Prefix"`
+	Delimiter             string         `xml:"Delimiter,omitempty"`
+	MaxKeys               int            `xml:"MaxKeys"`
+	KeyCount              int            `xml:"KeyCount"`
+	IsTruncated           bool           `xml:"IsTruncated"`
+	NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+	NextMarker            string         `xml:"NextMarker,omitempty"`
+	Contents              []Object       `xml:"Contents"`
+	CommonPrefixes        []CommonPrefix `xml:"CommonPrefixes"`
+}
+
+// S3ListObjects lists the keys of the key index (ListObjects V1 and V2)
+func S3ListObjects(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if config.Settings.Has(config.READ_TOKEN) && query.Get("token") != config.Settings.Get(config.READ_TOKEN) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintln(w, "Access forbidden")
+		return
+	}
+	maxKeys, err := strconv.Atoi(query.Get("max-keys"))
+	if err != nil || maxKeys < 1 || maxKeys > 1000 {
+		maxKeys = 1000
+	}
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+	after := query.Get("marker")
+	if query.Get("continuation-token") != "" {
+		after = query.Get("continuation-token")
+	} else if query.Get("start-after") != "" {
+		after = query.Get("start-after")
+	}
+	if delimiter != "" && strings.HasSuffix(after, delimiter) {
+		// Markers ending with the delimiter are common prefixes already listed
+		after = after + "\U0010FFFF"
+	}
+
+	result := ListBucketResult{
+		Xmlns:     "http://s3.amazonaws.com/doc/2006-03-01/",
+		Name:      "data",
+		Prefix:    prefix,
+		Delimiter: delimiter,
+		MaxKeys:   maxKeys,
+	}
+	last := ""
+	for _, record := range keyindex.List(prefix) {
+		if record.Key <= after {
+			continue
+		}
+		if result.KeyCount == maxKeys {
+			result.IsTruncated = true
+			break
+		}
+		if delimiter != "" {
+			if i := strings.Index(record.Key[len(prefix):], delimiter); i >= 0 {
+				commonPrefix := record.Key[:len(prefix)+i+len(delimiter)]
+				if commonPrefix != last {
+					result.CommonPrefixes = append(result.CommonPrefixes, CommonPrefix{Prefix: commonPrefix})
+					result.KeyCount++
+				}
+				// Continue after the whole common prefix
+				last = commonPrefix
+				after = commonPrefix + "\U0010FFFF"
+				continue
+			}
+		}
+		result.Contents = append(result.Contents, Object{
+			Key:          record.Key,
+			LastModified: record.Time.UTC().Format(time.RFC3339),
+			Size:         record.Size,
+			StorageClass: "STANDARD",
+		})
+		result.KeyCount++
+		last = record.Key
+	}
+	if result.IsTruncated {
+		if query.Get("list-type") == "2" {
+			result.NextContinuationToken = last
+		} else {
+			result.NextMarker = last
+		}
+	}
+	xmlEncoder(w).Encode(result)
+}
+
+func S3DeleteObjects(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	token := mux.Vars(r)["token"]
+	var request Delete
+	if err := xml.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err)
+		return
+	}
+	result := DeleteResult{Xmlns: "http://s3.amazonaws.com/doc/2006-03-01/"}
+	for _, object := range request.Objects {
+		err := deleteObject(token, object.Key)
+		if err == shared.ErrAccessDenied {
+			result.Errors = append(result.Errors, DeleteError{Key: object.Key, Code: "AccessDenied", Message: err.Error()})
+			continue
+		}
+		if err == shared.ErrTiered {
+			result.Errors = append(result.Errors, DeleteError{Key: object.Key, Code: "InvalidObjectState", Message: err.Error()})
+			continue
+		}
+		// S3 reports deleting a missing key as success
+		if err != nil && err != shared.ErrNotFound {
+			result.Errors = append(result.Errors, DeleteError{Key: object.Key, Code: "InternalError", Message: err.Error()})
+			continue
+		}
+		if !request.Quiet {
+			result.Deleted = append(result.Deleted, object)
+		}
+	}
+	xmlEncoder(w).Encode(result)
+}
+
+// S3Post stores the request body under a UUID generated by the server
+func S3Post(w http.ResponseWriter, r *http.Request) {
+	prometheus.RawUploadProcessed.Inc()
+	defer r.Body.Close()
+	fileBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, err)
+		return
+	}
+	id, err := shared.GenerateUUID(r.URL.Query().Get("uuid"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err)
+		return
+	}
+	result, err := shared.SharedUpload(r, r.URL.Query().Get("token"), id, fileBytes)
+	if err == nil {
+		hash := md5.Sum(fileBytes)
+		w.Header().Set("ETag", `"`+hex.EncodeToString(hash[:])+`"`)
+		w.Header().Set("Location", "/data/"+result.UUID)
+		result.Status = http.StatusCreated
+	}
+	jData, err := json.Marshal(result)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(result.Status)
+	w.Write(jData)
+}
+
 func S3Bucket(w http.ResponseWriter, r *http.Request) {
+	_, isDelete := r.URL.Query()["delete"]
+	if r.Method == "POST" && isDelete {
+		S3DeleteObjects(w, r)
+		return
+	}
+	if r.Method == "POST" {
+		S3Post(w, r)
+		return
+	}
+	if _, isLocation := r.URL.Query()["location"]; !isLocation && r.Method == "GET" && keyindex.Enabled() {
+		S3ListObjects(w, r)
+		return
+	}
 	result := GetBucketLocation{
 		Xmlns:              "http://s3.amazonaws.com/doc/2006-03-01/",
 		LocationConstraint: "",
@@ -43,6 +248,79 @@ func formatHeaderTime(t time.Time) string {
 	return tc.Format("Mon, 02 Jan 2006 15:04:05") + " GMT"
 }
 
+// resolveKey returns the time-UUID for a key. Keys that are not Time-UUID are
+// looked up in the key index when KEY_INDEX_SUPPORT is enabled.
+func resolveKey(key string) (string, bool, error) {
+	if !keyindex.Enabled() {
+		return key, false, nil
+	}
+	if _, _, err := shared.GetContainerFile(key); err == nil {
+		return key, false, nil
+	}
+	record, ok := keyindex.Lookup(key)
+	if !ok {
+		return "", true, shared.ErrNotFound
+	}
+	return record.UUID, true, nil
+}
+
+func deleteObject(token string, key string) error {
+	if config.Settings.Has(config.WRITE_TOKEN) && token != config.Settings.Get(config.WRITE_TOKEN) {
+		return shared.ErrAccessDenied
+	}
+	id, mapped, err := resolveKey(key)
+	if err != nil {
+		return err
+	}
+	err = shared.DeleteBlob(token, id)
+	if mapped && (err == nil || err == shared.ErrNotFound) {
+		if err := keyindex.Delete(key); err != nil {
+			return err
+		}
+		shared.CommitKey(key, "", 0, true)
+		return nil
+	}
+	return err
+}
+
+// ReplicateKey applies a key index commit shipped by a replicating peer.
+func ReplicateKey(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if !shared.Replicated(r) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintln(w, "Access forbidden")
+		return
+	}
+	if !keyindex.Enabled() {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintln(w, "Key index not enabled")
+		return
+	}
+	var commit shared.Commit
+	if err := json.NewDecoder(r.Body).Decode(&commit); err != nil || commit.Key == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, "Invalid key commit:", err)
+		return
+	}
+	var err error
+	switch commit.Op {
+	case shared.COMMIT_KEY:
+		err = keyindex.Add(commit.Key, commit.UUID, commit.Size)
+	case shared.COMMIT_KEY_DELETE:
+		err = keyindex.Delete(commit.Key)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, "Invalid key commit:", commit.Op)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func S3Put(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id, ok := vars["id"]
@@ -50,9 +328,19 @@ func S3Put(w http.ResponseWriter, r *http.Request) {
 		fmt.Println("id is missing in parameters")
 	}
 	switch r.Method {
-	case "GET":
+	case "GET", "HEAD":
 		{
-			w.Header().Set("Last-Modified", formatHeaderTime(shared.GetFileTime(id)))
+			uuid_id, mapped, err := resolveKey(id)
+			if err != nil {
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprintln(w, "File not found")
+				return
+			}
+			if mapped {
+				vars["id"] = uuid_id
+				r = mux.SetURLVars(r, vars)
+			}
+			w.Header().Set("Last-Modified", formatHeaderTime(shared.GetFileTime(uuid_id)))
 			shared.GetFile(w, r)
 		}
 	case "PUT":
@@ -77,14 +365,59 @@ func S3Put(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			_, _, err = shared.SharedUpload(r, token, id, fileBytes)
+			key := id
+			previous, mapped, _ := resolveKey(key)
+			if mapped {
+				if id, err = shared.GenerateUUID(""); err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					fmt.Fprintln(w, err)
+					return
+				}
+			}
+			result, err := shared.SharedUpload(r, token, id, fileBytes)
 			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
+				w.WriteHeader(shared.UploadStatus(err))
 				fmt.Fprintln(w, err)
 				return
 			}
+			if mapped {
+				if err := keyindex.Add(key, result.UUID, result.Size); err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					fmt.Fprintln(w, err)
+					return
+				}
+				if !shared.Replicated(r) {
+					shared.CommitKey(key, result.UUID, result.Size, false)
+				}
+				// The key now points at the new blob, the old one is no longer reachable
+				if previous != "" {
+					if err := shared.DeleteBlob(token, previous); err != nil {
+						fmt.Println("delete overwritten blob failed:", previous, err)
+					}
+				}
+			}
 			hash := md5.Sum(fileBytes)
 			w.Header().Set("ETag", `"`+hex.EncodeToString(hash[:])+`"`)
 		}
+	case "DELETE":
+		{
+			err := deleteObject(vars["token"], id)
+			if err == shared.ErrAccessDenied {
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprintln(w, "Access forbidden")
+				return
+			}
+			if err == shared.ErrTiered {
+				w.WriteHeader(http.StatusConflict)
+				fmt.Fprintln(w, err)
+				return
+			}
+			if err != nil && err != shared.ErrNotFound {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintln(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}
 	}
 }
@@ -0,0 +1,152 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"glacier/config"
+	"glacier/keyindex"
+	"glacier/shared"
+	"glacier/store"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+func TestMain(m *testing.M) {
+	config.Settings.Init()
+	os.Exit(m.Run())
+}
+
+func TestS3KeyIndex(t *testing.T) {
+	t.Cleanup(config.Settings.Override(config.KEY_INDEX_SUPPORT, "true"))
+	t.Cleanup(config.Settings.Override(config.DATA_FOLDER, t.TempDir()))
+	containers := shared.Containers
+	shared.Containers = store.NewMemory(1 << 30)
+	t.Cleanup(func() {
+		shared.FlushManifests()
+		shared.Containers = containers
+	})
+	if err := keyindex.Load(); err != nil {
+		t.Fatalf("Unable to load key index! Error:%v", err)
+	}
+	r := mux.NewRouter()
+	r.HandleFunc("/data/", S3Bucket)
+	r.HandleFunc("/data/{id:.+}", S3Put)
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	client, err := minio.New(server.Listener.Addr().String(), &minio.Options{
+		Creds:  credentials.NewStaticV2("aaaaaaaaaaaaaaaaaaaa", "sssssssssssssssssssssssssssssssssssssssssss", ""),
+		Secure: false,
+	})
+	if err != nil {
+		t.Fatalf("Panic:%v", err)
+	}
+	key := "sensor-a/2022/11/02/reading.json"
+	data := []byte(`{"temperature": 21.5}`)
+	_, err = client.PutObject(context.Background(), "data", key, bytes.NewReader(data), (int64)(len(data)), minio.PutObjectOptions{})
+	if err != nil {
+		t.Fatalf("S3 upload panic: %v", err)
+	}
+
+	object, err := client.GetObject(context.Background(), "data", key, minio.GetObjectOptions{})
+	if err != nil {
+		t.Fatalf("Unable to GetObject Error:%v", err)
+	}
+	outputData, err := ioutil.ReadAll(object)
+	if err != nil || bytes.Compare(outputData, data) != 0 {
+		t.Fatalf("Upload/download did not pass! Want:\"%v\" Have:\"%v\" Error:%v", string(data), string(outputData), err)
+	}
+
+	found := false
+	for info := range client.ListObjects(context.Background(), "data", minio.ListObjectsOptions{Prefix: "sensor-a/", Recursive: true}) {
+		if info.Err != nil {
+			t.Fatalf("Unable to ListObjects Error:%v", info.Err)
+		}
+		found = found || info.Key == key
+	}
+	if !found {
+		t.Fatalf("Key %v missing from ListObjects", key)
+	}
+
+	if err := client.RemoveObject(context.Background(), "data", key, minio.RemoveObjectOptions{}); err != nil {
+		t.Fatalf("Unable to RemoveObject Error:%v", err)
+	}
+	if _, err := client.StatObject(context.Background(), "data", key, minio.StatObjectOptions{}); err == nil {
+		t.Fatalf("Object still available after RemoveObject")
+	}
+
+	// Clients page with continuation-token (V2) and marker (V1)
+	pageKeys := []string{"page/a", "page/b", "page/c"}
+	for _, pageKey := range pageKeys {
+		_, err = client.PutObject(context.Background(), "data", pageKey, bytes.NewReader(data), (int64)(len(data)), minio.PutObjectOptions{})
+		if err != nil {
+			t.Fatalf("S3 upload panic: %v", err)
+		}
+	}
+	for _, useV1 := range []bool{false, true} {
+		var listed []string
+		for info := range client.ListObjects(context.Background(), "data", minio.ListObjectsOptions{Prefix: "page/", Recursive: true, MaxKeys: 1, UseV1: useV1}) {
+			if info.Err != nil {
+				t.Fatalf("Unable to ListObjects Error:%v", info.Err)
+			}
+			listed = append(listed, info.Key)
+		}
+		if strings.Join(listed, ",") != strings.Join(pageKeys, ",") {
+			t.Fatalf("Wrong pages! V1:%v Have:%v", useV1, listed)
+		}
+	}
+
+	// Keys of containers removed by autoclean leave the index
+	record, _ := keyindex.Lookup("page/a")
+	containerFile, _, _ := shared.GetContainerFile(record.UUID)
+	if err := shared.RemoveSegment(containerFile); err != nil {
+		t.Fatalf("Unable to remove container! Error:%v", err)
+	}
+	if _, ok := keyindex.Lookup("page/a"); ok {
+		t.Fatalf("Key of removed container still indexed")
+	}
+}
+
+func TestReplicateKey(t *testing.T) {
+	t.Cleanup(config.Settings.Override(config.KEY_INDEX_SUPPORT, "true"))
+	t.Cleanup(config.Settings.Override(config.DATA_FOLDER, t.TempDir()))
+	t.Cleanup(config.Settings.Override(config.REPLICATION_PEER_TOKEN, "peer-token"))
+	if err := keyindex.Load(); err != nil {
+		t.Fatalf("Unable to load key index! Error:%v", err)
+	}
+	test_uuid := shared.GenerateTimeUUID()
+	send := func(token string, commit string) int {
+		r := httptest.NewRequest("POST", "/keyindex", strings.NewReader(commit))
+		r.Header.Set(shared.REPLICATED_HEADER, token)
+		w := httptest.NewRecorder()
+		ReplicateKey(w, r)
+		return w.Code
+	}
+
+	if status := send("true", `{"Op":"key","UUID":"`+test_uuid+`","Key":"peer/key","Size":4}`); status != http.StatusForbidden {
+		t.Fatalf("Key commit accepted without peer token! Have:%v", status)
+	}
+	if _, ok := keyindex.Lookup("peer/key"); ok {
+		t.Fatalf("Key indexed without peer token")
+	}
+	if status := send("peer-token", `{"Op":"key","UUID":"`+test_uuid+`","Key":"peer/key","Size":4}`); status != http.StatusNoContent {
+		t.Fatalf("Key commit refused! Have:%v", status)
+	}
+	if record, ok := keyindex.Lookup("peer/key"); !ok || record.UUID != test_uuid || record.Size != 4 {
+		t.Fatalf("Wrong replicated key! Have:%+v", record)
+	}
+	if status := send("peer-token", `{"Op":"keydelete","Key":"peer/key"}`); status != http.StatusNoContent {
+		t.Fatalf("Key delete refused! Have:%v", status)
+	}
+	if _, ok := keyindex.Lookup("peer/key"); ok {
+		t.Fatalf("Replicated key delete not applied")
+	}
+}
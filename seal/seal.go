@@ -0,0 +1,26 @@
+package seal
+
+import (
+	"fmt"
+	"glacier/shared"
+	"time"
+)
+
+// Sealer sorts and indexes the containers of folders whose time is over, and
+// moves them to the STORAGE_BACKEND store after TIERING_AGE.
+func Sealer() {
+	fmt.Println("Sealer start")
+	for {
+		if shared.SealEnabled() {
+			if err := shared.SealPending(); err != nil {
+				fmt.Printf("error listing the path %q: %v\n", shared.CONTAINER_ROOT, err)
+			}
+		}
+		if _, ok := shared.TieringAge(); ok {
+			if err := shared.TierPending(); err != nil {
+				fmt.Printf("error listing the path %q: %v\n", shared.CONTAINER_ROOT, err)
+			}
+		}
+		time.Sleep(600000 * time.Millisecond)
+	}
+}
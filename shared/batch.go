@@ -0,0 +1,173 @@
+package shared
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"glacier/config"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type BatchRequest struct {
+	Ids    []string
+	From   time.Time
+	To     time.Time
+	Format string // tar (default) or zip
+}
+
+// batchArchive hides the difference between tar and zip output.
+type batchArchive interface {
+	add(name string, size int64, modTime time.Time, content io.Reader) error
+	Close() error
+}
+
+type tarArchive struct{ tw *tar.Writer }
+
+func (a *tarArchive) add(name string, size int64, modTime time.Time, content io.Reader) error {
+	hdr := &tar.Header{Name: name, Size: size, Mode: 0600, ModTime: modTime}
+	if err := a.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := io.Copy(a.tw, content)
+	return err
+}
+
+func (a *tarArchive) Close() error { return a.tw.Close() }
+
+type zipArchive struct{ zw *zip.Writer }
+
+func (a *zipArchive) add(name string, size int64, modTime time.Time, content io.Reader) error {
+	fw, err := a.zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modTime})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, content)
+	return err
+}
+
+func (a *zipArchive) Close() error { return a.zw.Close() }
+
+// BatchGet streams many blobs back as one tar or zip archive. Blobs are
+// grouped by container so every container is opened and scanned once.
+func BatchGet(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	token := mux.Vars(r)["token"]
+	if config.Settings.Has(config.READ_TOKEN) && token != config.Settings.Get(config.READ_TOKEN) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintln(w, "Access forbidden")
+		return
+	}
+	var request BatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err)
+		return
+	}
+
+	// containerFile -> wanted ids, and the containers of the time range
+	wanted := make(map[string]map[string]bool)
+	inRange := make(map[string]bool)
+	var missing []string
+	for _, id := range request.Ids {
+		containerFile, uuid_id, err := GetContainerFile(id)
+		if err != nil {
+			missing = append(missing, id)
+			continue
+		}
+		if wanted[containerFile] == nil {
+			wanted[containerFile] = make(map[string]bool)
+		}
+		wanted[containerFile][uuid_id] = true
+	}
+	if !request.From.IsZero() && !request.To.IsZero() {
+		containers, err := ContainersInRange(request.From, request.To)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintln(w, err)
+			return
+		}
+		for _, containerFile := range containers {
+			inRange[containerFile] = true
+		}
+	}
+	containers := make([]string, 0, len(wanted)+len(inRange))
+	for containerFile := range wanted {
+		containers = append(containers, containerFile)
+	}
+	for containerFile := range inRange {
+		if wanted[containerFile] == nil {
+			containers = append(containers, containerFile)
+		}
+	}
+	sort.Strings(containers)
+
+	var archive batchArchive
+	if strings.ToLower(request.Format) == "zip" {
+		w.Header().Set("Content-Type", "application/zip")
+		archive = &zipArchive{zw: zip.NewWriter(w)}
+	} else {
+		w.Header().Set("Content-Type", "application/x-tar")
+		archive = &tarArchive{tw: tar.NewWriter(w)}
+	}
+	for _, containerFile := range containers {
+		ids := wanted[containerFile]
+		match := func(id string) bool {
+			return ids[id] || inRange[containerFile] && inTimeRange(id, request.From, request.To)
+		}
+		found, err := batchContainer(archive, containerFile, match)
+		if err != nil {
+			fmt.Println("batch get failed:", containerFile, err)
+		}
+		for id := range ids {
+			if !found[id] {
+				missing = append(missing, id)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		list := strings.Join(missing, "\n") + "\n"
+		archive.add("missing.txt", int64(len(list)), time.Now(), strings.NewReader(list))
+	}
+	if err := archive.Close(); err != nil {
+		fmt.Println("batch get failed:", err)
+	}
+}
+
+// batchContainer adds the blobs of one container accepted by match to the archive and returns the ids found.
+func batchContainer(archive batchArchive, containerFile string, match func(id string) bool) (map[string]bool, error) {
+	found := make(map[string]bool)
+	c, err := openContainer(containerFile)
+	if err != nil {
+		return found, err
+	}
+	defer c.Close()
+	entries, order, err := collectEntries(c, "", match)
+	if err != nil {
+		return found, err
+	}
+	for _, id := range order {
+		entry, err := selectEntry(entries[id], "")
+		if err != nil {
+			continue
+		}
+		content, err := entryContent(entry)
+		if err != nil {
+			return found, err
+		}
+		err = archive.add(id, entry.realSize(), GetFileTime(id), content)
+		content.Close()
+		if err != nil {
+			return found, err
+		}
+		found[id] = true
+	}
+	return found, nil
+}
@@ -0,0 +1,57 @@
+package shared
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestBatchGet(t *testing.T) {
+	memoryContainers(t)
+	server := testServer(t)
+	want := make(map[string]string)
+	var ids []string
+	for i := 0; i < 3; i++ {
+		test_uuid := GenerateTimeUUID()
+		want[test_uuid] = "batch blob " + test_uuid
+		ids = append(ids, test_uuid)
+		testUpload(t, test_uuid, "", want[test_uuid])
+	}
+	missing_uuid := GenerateTimeUUID()
+	ids = append(ids, missing_uuid)
+
+	request, _ := json.Marshal(BatchRequest{Ids: ids})
+	resp, err := http.Post(server.URL+"/batch", "application/json", bytes.NewReader(request))
+	if err != nil {
+		t.Fatalf("Unable to batch get! Error:%v", err)
+	}
+	defer resp.Body.Close()
+	tr := tar.NewReader(resp.Body)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Unable to read batch archive! Error:%v", err)
+		}
+		content, _ := ioutil.ReadAll(tr)
+		if hdr.Name == "missing.txt" {
+			if string(content) != missing_uuid+"\n" {
+				t.Fatalf("Wrong missing list! Have:\"%v\"", string(content))
+			}
+			continue
+		}
+		if want[hdr.Name] != string(content) {
+			t.Fatalf("Wrong batch content for %v! Have:\"%v\"", hdr.Name, string(content))
+		}
+		delete(want, hdr.Name)
+	}
+	if len(want) > 0 {
+		t.Fatalf("Blobs missing from batch archive: %v", want)
+	}
+}
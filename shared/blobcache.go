@@ -0,0 +1,140 @@
+package shared
+
+import (
+	"container/list"
+	"glacier/config"
+	"glacier/prometheus"
+	"strconv"
+	"sync"
+)
+
+type cachedBlob struct {
+	id            string
+	variant       string
+	containerFile string
+	mimeType      string
+	versionId     string
+	data          []byte
+}
+
+// Decompressed content of recently read blobs, most recently used first.
+var blobCache = struct {
+	sync.Mutex
+	lru      *list.List
+	byId     map[string]map[string]*list.Element // id -> variant -> blob
+	bytes    int64
+	inflight map[string]*blobRead
+}{lru: list.New(), byId: make(map[string]map[string]*list.Element), inflight: make(map[string]*blobRead)}
+
+// blobRead tracks the reads of an id filling the cache, so a write committed
+// during the read keeps the old content out of the cache.
+type blobRead struct {
+	readers int
+	stale   bool
+}
+
+func blobCacheSize() int64 {
+	size, err := strconv.ParseInt(config.Settings.Get(config.BLOB_CACHE_SIZE), 10, 64)
+	if err != nil || size < 0 {
+		return 0
+	}
+	return size << 20
+}
+
+// blobCacheable reports if a blob of realSize bytes is kept in the cache.
+func blobCacheable(realSize int64) bool {
+	max, err := strconv.ParseInt(config.Settings.Get(config.BLOB_CACHE_MAX_BLOB), 10, 64)
+	if err != nil {
+		max = 256
+	}
+	return blobCacheSize() > 0 && realSize <= max<<10
+}
+
+// getCachedBlob returns the cached blob, or registers a read of id that can be
+// added with putCachedBlob. Every miss must be ended with endBlobRead.
+func getCachedBlob(id string, variant string) (*cachedBlob, bool) {
+	blobCache.Lock()
+	defer blobCache.Unlock()
+	if e, ok := blobCache.byId[id][variant]; ok {
+		prometheus.BlobCacheHits.Inc()
+		blobCache.lru.MoveToFront(e)
+		return e.Value.(*cachedBlob), true
+	}
+	prometheus.BlobCacheMisses.Inc()
+	read, ok := blobCache.inflight[id]
+	if !ok {
+		read = &blobRead{}
+		blobCache.inflight[id] = read
+	}
+	read.readers++
+	return nil, false
+}
+
+// putCachedBlob adds the blob read since the miss, unless id was written meanwhile.
+func putCachedBlob(blob *cachedBlob) {
+	blobCache.Lock()
+	defer blobCache.Unlock()
+	if read := blobCache.inflight[blob.id]; read == nil || read.stale {
+		return
+	}
+	if _, ok := blobCache.byId[blob.id][blob.variant]; ok {
+		return
+	}
+	if blobCache.byId[blob.id] == nil {
+		blobCache.byId[blob.id] = make(map[string]*list.Element)
+	}
+	blobCache.byId[blob.id][blob.variant] = blobCache.lru.PushFront(blob)
+	blobCache.bytes += int64(len(blob.data))
+	for size := blobCacheSize(); blobCache.bytes > size; {
+		prometheus.BlobCacheEvictions.Inc()
+		removeCachedBlob(blobCache.lru.Back())
+	}
+	prometheus.BlobCacheBytes.Set(float64(blobCache.bytes))
+}
+
+func endBlobRead(id string) {
+	blobCache.Lock()
+	defer blobCache.Unlock()
+	if read := blobCache.inflight[id]; read != nil {
+		read.readers--
+		if read.readers == 0 {
+			delete(blobCache.inflight, id)
+		}
+	}
+}
+
+func removeCachedBlob(e *list.Element) {
+	blob := blobCache.lru.Remove(e).(*cachedBlob)
+	delete(blobCache.byId[blob.id], blob.variant)
+	if len(blobCache.byId[blob.id]) == 0 {
+		delete(blobCache.byId, blob.id)
+	}
+	blobCache.bytes -= int64(len(blob.data))
+}
+
+// invalidateBlob drops every cached variant of id after a write or delete of id.
+func invalidateBlob(id string) {
+	blobCache.Lock()
+	defer blobCache.Unlock()
+	if read := blobCache.inflight[id]; read != nil {
+		read.stale = true
+	}
+	for _, e := range blobCache.byId[id] {
+		removeCachedBlob(e)
+	}
+	prometheus.BlobCacheBytes.Set(float64(blobCache.bytes))
+}
+
+// invalidateBlobsIn drops the cached blobs of a container removed from disk.
+func invalidateBlobsIn(containerFile string) {
+	blobCache.Lock()
+	defer blobCache.Unlock()
+	for e := blobCache.lru.Front(); e != nil; {
+		next := e.Next()
+		if e.Value.(*cachedBlob).containerFile == containerFile {
+			removeCachedBlob(e)
+		}
+		e = next
+	}
+	prometheus.BlobCacheBytes.Set(float64(blobCache.bytes))
+}
@@ -0,0 +1,115 @@
+package shared
+
+import (
+	"glacier/config"
+	"io/ioutil"
+	"net/http"
+)
+
+// Operations of a Commit
+const (
+	COMMIT_PUT        = "put"
+	COMMIT_DELETE     = "delete"
+	COMMIT_KEY        = "key"
+	COMMIT_KEY_DELETE = "keydelete"
+)
+
+// Commit describes a blob write or delete committed to its container, or an
+// S3 key mapped to or removed from the key index.
+type Commit struct {
+	Op        string
+	UUID      string
+	Variant   string `json:",omitempty"`
+	VersionId string `json:",omitempty"`
+	Key       string `json:",omitempty"`
+	Size      int64  `json:",omitempty"`
+}
+
+// OnCommit is called after every committed write and delete, e.g. to replicate it.
+var OnCommit func(commit Commit)
+
+// Header carrying REPLICATION_PEER_TOKEN on writes and deletes replicated from
+// a peer, they are not replicated again
+const REPLICATED_HEADER = "X-Glacier-Replicated"
+
+// Replicated reports if the request was replicated from a peer. Without
+// REPLICATION_PEER_TOKEN no request is taken as replicated.
+func Replicated(r *http.Request) bool {
+	token := config.Settings.Get(config.REPLICATION_PEER_TOKEN)
+	return token != "" && r.Header.Get(REPLICATED_HEADER) == token
+}
+
+func notifyCommit(commit Commit) {
+	if OnCommit != nil {
+		OnCommit(commit)
+	}
+}
+
+// CommitKey notifies that the S3 key was mapped to the time-UUID, or removed
+// from the key index when deleted is set.
+func CommitKey(key string, uuid string, size int64, deleted bool) {
+	if deleted {
+		notifyCommit(Commit{Op: COMMIT_KEY_DELETE, Key: key})
+		return
+	}
+	notifyCommit(Commit{Op: COMMIT_KEY, UUID: uuid, Key: key, Size: size})
+}
+
+// ReadBlob returns the content and MIME type of the blob variant, or of the
+// given version.
+func ReadBlob(id string, variant string, versionId string) ([]byte, string, error) {
+	containerFile, id, err := GetContainerFile(id)
+	if err != nil {
+		return nil, "", err
+	}
+	c, err := openContainer(containerFile)
+	if err != nil {
+		return nil, "", err
+	}
+	defer c.Close()
+	entry, err := findEntry(c, id, variant, versionId)
+	if err != nil {
+		return nil, "", err
+	}
+	content, err := entryContent(entry)
+	if err != nil {
+		return nil, "", err
+	}
+	defer content.Close()
+	data, err := ioutil.ReadAll(content)
+	return data, entry.hdr.Gname, err
+}
+
+// ContainerCommits returns a put for every visible blob of the container, the
+// originals before their variants, in the order they were written.
+func ContainerCommits(containerFile string) ([]Commit, error) {
+	c, err := openContainer(containerFile)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	blobs := make(map[string][]Commit)
+	var order []string
+	err = c.scan(func(entry containerEntry) error {
+		hdr := entry.hdr
+		if isTombstone(hdr) {
+			delete(blobs, hdr.Name)
+			return nil
+		}
+		if _, seen := blobs[hdr.Name]; !seen {
+			order = append(order, hdr.Name)
+		}
+		blobs[hdr.Name] = append(blobs[hdr.Name], Commit{
+			Op:        COMMIT_PUT,
+			UUID:      hdr.Name,
+			Variant:   hdr.PAXRecords[PAX_VARIANT],
+			VersionId: hdr.PAXRecords[PAX_VERSION_ID],
+		})
+		return nil
+	})
+	var commits []Commit
+	for _, id := range order {
+		commits = append(commits, blobs[id]...)
+	}
+	return commits, err
+}
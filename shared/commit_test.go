@@ -0,0 +1,54 @@
+package shared
+
+import (
+	"glacier/config"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestReplicatedWrite(t *testing.T) {
+	memoryContainers(t)
+	t.Cleanup(config.Settings.Override(config.REPLICATION_PEER_TOKEN, "peer-token"))
+	var mutex sync.Mutex
+	var commits []Commit
+	OnCommit = func(commit Commit) {
+		mutex.Lock()
+		commits = append(commits, commit)
+		mutex.Unlock()
+	}
+	defer func() { OnCommit = nil }()
+	server := testServer(t)
+
+	// Writes and deletes received from a peer are not replicated again
+	test_uuid := GenerateTimeUUID()
+	peer := http.Header{REPLICATED_HEADER: {"peer-token"}}
+	r := httptest.NewRequest("POST", "/rawupload/"+test_uuid, nil)
+	r.Header = peer
+	if _, err := SharedUpload(r, "", test_uuid, []byte("replicated")); err != nil {
+		t.Fatalf("Upload failed! Error:%v", err)
+	}
+	if status, body := testRequest(t, "DELETE", server.URL+"/get/"+test_uuid, peer); status != http.StatusNoContent {
+		t.Fatalf("Unable to delete file! Have:%v \"%v\"", status, body)
+	}
+	mutex.Lock()
+	if len(commits) != 0 {
+		t.Fatalf("Replicated requests notified! Have:%v", commits)
+	}
+	mutex.Unlock()
+
+	// Clients without the peer token are replicated
+	local_uuid := GenerateTimeUUID()
+	r = httptest.NewRequest("POST", "/rawupload/"+local_uuid, nil)
+	r.Header.Set(REPLICATED_HEADER, "true")
+	if _, err := SharedUpload(r, "", local_uuid, []byte("local")); err != nil {
+		t.Fatalf("Upload failed! Error:%v", err)
+	}
+	testRequest(t, "DELETE", server.URL+"/get/"+local_uuid, http.Header{REPLICATED_HEADER: {"true"}})
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(commits) != 2 || commits[0].Op != COMMIT_PUT || commits[1].Op != COMMIT_DELETE {
+		t.Fatalf("Local writes not notified! Have:%v", commits)
+	}
+}
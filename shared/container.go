@@ -0,0 +1,617 @@
+package shared
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"glacier/config"
+	"glacier/prometheus"
+	"glacier/store"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// PAX record marking a tar entry as a tombstone for a previously stored blob
+	PAX_TOMBSTONE = "GLACIER.tombstone"
+	// PAX record holding the version of a blob when DUPLICATE_POLICY is version
+	PAX_VERSION_ID = "GLACIER.versionid"
+	// PAX record naming the variant (thumb, preview...) of the blob with the same UUID
+	PAX_VARIANT = "GLACIER.variant"
+)
+
+// Values of the tar header Mode telling how the entry content is compressed
+const (
+	MODE_GZIP = 1
+	MODE_ZSTD = 2 // Recompressed by the seal
+)
+
+// Values of DUPLICATE_POLICY deciding what happens when the same UUID is written twice
+const (
+	DUPLICATE_FIRST   = "first"
+	DUPLICATE_REJECT  = "reject"
+	DUPLICATE_LAST    = "last"
+	DUPLICATE_VERSION = "version"
+)
+
+var (
+	ErrNotFound     = errors.New("File not found")
+	ErrAccessDenied = errors.New("Access denied")
+	ErrDuplicate    = errors.New("UUID already exists")
+	ErrEmptyFile    = errors.New("File is empty")
+	ErrNoOriginal   = errors.New("Original file not found for variant")
+	ErrVariantName  = errors.New("Variant name must match " + variantRegex.String())
+	ErrTiered       = errors.New("Tiered blobs can not be deleted")
+)
+
+// invalidUUIDError wraps errors from GetContainerFile on upload
+type invalidUUIDError struct{ error }
+
+// Containers stores the container segments, as tar files below the working
+// directory unless replaced, e.g. by an in-memory store in tests.
+var Containers store.Store = &store.Disk{}
+
+type containerEntry struct {
+	hdr    *tar.Header
+	reader io.ReaderAt   // Segment holding the entry
+	remote *remoteObject // Tiered segment holding the entry, instead of reader
+	offset int64         // Start of the entry content in the segment
+}
+
+// Names of variants, which are written into links of the web-GUI
+var variantRegex = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// ValidVariant reports if variant is the original blob or a valid variant name.
+func ValidVariant(variant string) bool {
+	return variant == "" || variantRegex.MatchString(variant)
+}
+
+// Numbered segments xx.1.tar, xx.2.tar... continuing the container xx.tar
+var segmentRegex = regexp.MustCompile(`\.([0-9]+)\.tar$`)
+
+// BaseContainer returns the container a segment file belongs to.
+func BaseContainer(segmentFile string) string {
+	return segmentRegex.ReplaceAllString(segmentFile, ".tar")
+}
+
+func segmentNumber(segmentFile string) int {
+	match := segmentRegex.FindStringSubmatch(segmentFile)
+	if match == nil {
+		return 0
+	}
+	number, _ := strconv.Atoi(match[1])
+	return number
+}
+
+func segmentName(containerFile string, number int) string {
+	if number == 0 {
+		return containerFile
+	}
+	return strings.TrimSuffix(containerFile, ".tar") + "." + strconv.Itoa(number) + ".tar"
+}
+
+// segmentFiles returns the existing segments of the container in write order.
+func segmentFiles(containerFile string) ([]string, error) {
+	var files []string
+	err := Containers.List(path.Dir(containerFile), func(name string) error {
+		if name == containerFile || (segmentNumber(name) > 0 && BaseContainer(name) == containerFile) {
+			files = append(files, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool { return segmentNumber(files[i]) < segmentNumber(files[j]) })
+	return files, nil
+}
+
+// maxContainerSize returns MAX_CONTAINER_SIZE in bytes, 0 when segments are unlimited.
+func maxContainerSize() int64 {
+	size, err := strconv.ParseInt(config.Settings.Get(config.MAX_CONTAINER_SIZE), 10, 64)
+	if err != nil || size < 0 {
+		return 0
+	}
+	return size << 20
+}
+
+type segment struct {
+	name   string
+	reader store.Reader // nil until the segment is written
+	index  *sealIndex   // Set when the segment is sealed
+}
+
+// container holds the open segments of a container. The lock of the container
+// guards all its segments.
+type container struct {
+	name     string
+	segments []*segment
+	snapshot bool         // Scan only the committed entries, without holding the lock
+	catalog  *tierCatalog // Entries tiered to the cold store, older than the segments
+	readers  []store.Reader
+	written  map[string]bool // Segments appended to, synced by the writer
+}
+
+// openContainer opens the segments of an existing container for reading the
+// entries committed by writers. Appends never change committed entries, so
+// the container is read without its lock.
+func openContainer(containerFile string) (*container, error) {
+	c := &container{name: containerFile, snapshot: true}
+	if err := c.refresh(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	// Tiered containers stay readable after tiering is disabled
+	catalog, err := loadCatalog(containerFile)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.catalog = catalog
+	if len(c.segments) == 0 && c.catalog == nil {
+		return nil, &os.PathError{Op: "open", Path: containerFile, Err: os.ErrNotExist}
+	}
+	return c, nil
+}
+
+// refresh opens the segments created since the container was opened.
+func (c *container) refresh() error {
+	files, err := segmentFiles(c.name)
+	if err != nil {
+		return err
+	}
+	open := make(map[string]bool)
+	for _, s := range c.segments {
+		open[s.name] = true
+	}
+	for _, file := range files {
+		if open[file] {
+			continue
+		}
+		reader, err := c.open(file)
+		if os.IsNotExist(err) {
+			// Removed since listed
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		s := &segment{name: file, reader: reader}
+		if SealEnabled() {
+			if s.index, err = c.openIndex(file, reader); err != nil {
+				return err
+			}
+		}
+		c.segments = append(c.segments, s)
+	}
+	sort.Slice(c.segments, func(i, j int) bool {
+		return segmentNumber(c.segments[i].name) < segmentNumber(c.segments[j].name)
+	})
+	return nil
+}
+
+// open opens a reader of the segment, closed with the container.
+func (c *container) open(segmentFile string) (store.Reader, error) {
+	reader, err := Containers.Reader(segmentFile)
+	if err != nil {
+		return nil, err
+	}
+	c.readers = append(c.readers, reader)
+	return reader, nil
+}
+
+func (c *container) Close() error {
+	var err error
+	for _, reader := range c.readers {
+		if closeErr := reader.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// sync commits the written segments to disk.
+func (c *container) sync() error {
+	for name := range c.written {
+		if err := Containers.Sync(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// current returns a reader of the segment including the entries appended by
+// the container writer.
+func (c *container) current(s *segment) (store.Reader, error) {
+	if c.snapshot || !c.written[s.name] {
+		return s.reader, nil
+	}
+	return c.open(s.name)
+}
+
+// scan calls fn for every entry of all segments in write order.
+func (c *container) scan(fn func(entry containerEntry) error) error {
+	return c.scanName("", fn)
+}
+
+// scanName calls fn in write order for the entries named name, or for every
+// entry when name is empty. Sealed segments look name up in their index.
+func (c *container) scanName(name string, fn func(entry containerEntry) error) error {
+	if c.catalog != nil {
+		if err := scanCatalog(c.catalog, fn); err != nil {
+			return err
+		}
+	}
+	for _, s := range c.segments {
+		reader, err := c.current(s)
+		if err != nil {
+			return err
+		}
+		if reader == nil {
+			continue
+		}
+		if name != "" && s.index != nil {
+			err := s.index.lookup(reader, name, fn)
+			if err != errStaleIndex {
+				if err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		length := reader.Size()
+		if c.snapshot {
+			length = committedEntries(s.name, reader)
+		}
+		err = scanSection(io.NewSectionReader(reader, 0, length), func(hdr *tar.Header, offset int64) error {
+			return fn(containerEntry{hdr: hdr, reader: reader, offset: offset})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendEntries appends the entries from write to the last segment, or to a
+// new segment when the last one is sealed or reached MAX_CONTAINER_SIZE.
+func (c *container) appendEntries(write func(tw *tar.Writer) error) error {
+	last := c.segments[len(c.segments)-1]
+	full := last.index != nil
+	if !full && !SealEnabled() {
+		// Sealed before SEAL_SUPPORT was turned off, the segment is read-only
+		_, err := Containers.Size(last.name + SEAL_INDEX)
+		full = err == nil
+	}
+	if max := maxContainerSize(); max > 0 && !full {
+		size, err := segmentSize(last.name)
+		if err != nil {
+			return err
+		}
+		full = size >= max
+	}
+	if full {
+		last = &segment{name: segmentName(c.name, segmentNumber(last.name)+1)}
+		c.segments = append(c.segments, last)
+	}
+	if err := beginAppend(last.name); err != nil {
+		return err
+	}
+	if c.written == nil {
+		c.written = make(map[string]bool)
+	}
+	c.written[last.name] = true
+	return Containers.Append(last.name, write)
+}
+
+// segmentSize returns the length of the segment, 0 when not yet written.
+func segmentSize(segmentFile string) (int64, error) {
+	size, err := Containers.Size(segmentFile)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	return size, err
+}
+
+// rewrite replaces every segment losing entries by the entries accepted by
+// keep, and counts the container again for its manifest. The index counts
+// entries over all segments.
+func (c *container) rewrite(keep func(index int, hdr *tar.Header) bool) error {
+	first := 0
+	for _, s := range c.segments {
+		reader, err := c.current(s)
+		if err != nil {
+			return err
+		}
+		if reader == nil {
+			continue
+		}
+		start := first
+		count, err := rewriteContainer(s.name, reader, func(index int, hdr *tar.Header) bool { return keep(start+index, hdr) })
+		if err != nil {
+			return err
+		}
+		first += count
+	}
+	return refreshManifest(c.name)
+}
+
+func isTombstone(hdr *tar.Header) bool {
+	return hdr.PAXRecords[PAX_TOMBSTONE] == "true"
+}
+
+// scanContainer calls fn for every entry of the segment with the offset of its content.
+func scanContainer(reader store.Reader, fn func(hdr *tar.Header, offset int64) error) error {
+	return scanSection(io.NewSectionReader(reader, 0, reader.Size()), fn)
+}
+
+// scanSection calls fn for every entry in the section, which ends at the
+// end-of-archive marker or at the end of the last entry.
+func scanSection(section *io.SectionReader, fn func(hdr *tar.Header, offset int64) error) error {
+	tr := tar.NewReader(section)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		offset, err := section.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		if err := fn(hdr, offset); err != nil {
+			return err
+		}
+	}
+}
+
+// collectEntries returns the entries of the variant written after the last
+// tombstone of their id, for every id accepted by match, and the ids in
+// container order. The original blob is the empty variant.
+func collectEntries(c *container, variant string, match func(id string) bool) (map[string][]containerEntry, []string, error) {
+	return collectScanned(c.scan, variant, match)
+}
+
+func collectScanned(scan func(fn func(entry containerEntry) error) error, variant string, match func(id string) bool) (map[string][]containerEntry, []string, error) {
+	entries := make(map[string][]containerEntry)
+	var order []string
+	err := scan(func(entry containerEntry) error {
+		hdr := entry.hdr
+		if !match(hdr.Name) {
+			return nil
+		}
+		if isTombstone(hdr) {
+			delete(entries, hdr.Name)
+			return nil
+		}
+		if hdr.PAXRecords[PAX_VARIANT] != variant {
+			return nil
+		}
+		if _, seen := entries[hdr.Name]; !seen {
+			order = append(order, hdr.Name)
+		}
+		entries[hdr.Name] = append(entries[hdr.Name], entry)
+		return nil
+	})
+	visible := order[:0]
+	for _, id := range order {
+		if _, ok := entries[id]; ok {
+			visible = append(visible, id)
+		}
+	}
+	return entries, visible, err
+}
+
+// visibleEntries returns the entries of the id variant written after the last
+// tombstone of id.
+func visibleEntries(c *container, id string, variant string) ([]containerEntry, error) {
+	scan := func(fn func(entry containerEntry) error) error { return c.scanName(id, fn) }
+	entries, _, err := collectScanned(scan, variant, func(name string) bool { return name == id })
+	return entries[id], err
+}
+
+// selectEntry returns the entry selected by the duplicate policy, or the entry
+// with the given versionId.
+func selectEntry(entries []containerEntry, versionId string) (*containerEntry, error) {
+	if len(entries) == 0 {
+		return nil, ErrNotFound
+	}
+	if versionId != "" {
+		for i := range entries {
+			if entries[i].hdr.PAXRecords[PAX_VERSION_ID] == versionId {
+				return &entries[i], nil
+			}
+		}
+		return nil, ErrNotFound
+	}
+	switch config.Settings.Get(config.DUPLICATE_POLICY) {
+	case DUPLICATE_LAST, DUPLICATE_VERSION:
+		return &entries[len(entries)-1], nil
+	}
+	return &entries[0], nil
+}
+
+// findEntry returns the entry of the id variant selected by the duplicate
+// policy, or the entry with the given versionId.
+func findEntry(c *container, id string, variant string, versionId string) (*containerEntry, error) {
+	entries, err := visibleEntries(c, id, variant)
+	if err != nil {
+		return nil, err
+	}
+	return selectEntry(entries, versionId)
+}
+
+func (entry *containerEntry) realSize() int64 {
+	if entry.hdr.Mode != 0 {
+		return int64(entry.hdr.Uid)
+	}
+	return entry.hdr.Size
+}
+
+// entryContent returns the uncompressed content of the entry.
+func entryContent(entry *containerEntry) (io.ReadCloser, error) {
+	var content io.ReadCloser
+	if entry.remote != nil {
+		var err error
+		if content, err = entry.remote.openRange(entry.offset, entry.hdr.Size); err != nil {
+			return nil, err
+		}
+	} else {
+		content = ioutil.NopCloser(io.NewSectionReader(entry.reader, entry.offset, entry.hdr.Size))
+	}
+	switch entry.hdr.Mode {
+	case MODE_GZIP:
+		return gzipReadCloser(content)
+	case MODE_ZSTD:
+		return zstdReadCloser(content)
+	}
+	return content, nil
+}
+
+// gzipReader closes the compressed stream with the reader.
+type gzipReader struct {
+	*gzip.Reader
+	compressed io.Closer
+}
+
+func (r gzipReader) Close() error {
+	r.Reader.Close()
+	return r.compressed.Close()
+}
+
+func gzipReadCloser(compressed io.ReadCloser) (io.ReadCloser, error) {
+	reader, err := gzip.NewReader(compressed)
+	if err != nil {
+		compressed.Close()
+		return nil, err
+	}
+	return gzipReader{Reader: reader, compressed: compressed}, nil
+}
+
+// zstdReader closes the compressed stream with the reader.
+type zstdReader struct {
+	*zstd.Decoder
+	compressed io.Closer
+}
+
+func (r zstdReader) Close() error {
+	r.Decoder.Close()
+	return r.compressed.Close()
+}
+
+func zstdReadCloser(compressed io.ReadCloser) (io.ReadCloser, error) {
+	reader, err := zstd.NewReader(compressed)
+	if err != nil {
+		compressed.Close()
+		return nil, err
+	}
+	return zstdReader{Decoder: reader, compressed: compressed}, nil
+}
+
+// withLockedContainer opens the container segments, creating the container
+// when missing, while holding its lock.
+func withLockedContainer(containerFile string, fn func(c *container) error) error {
+	unlock, err := Containers.Lock(containerFile)
+	if err != nil {
+		fmt.Println("lock failed:", err)
+		return err
+	}
+	defer unlock()
+	return withOpenContainer(containerFile, fn)
+}
+
+// withOpenContainer opens the container segments for writing, creating the
+// container when missing. The caller holds the container lock.
+func withOpenContainer(containerFile string, fn func(c *container) error) error {
+	prometheus.Tar_files_open.Inc()
+	defer prometheus.Tar_files_open.Dec()
+
+	c := &container{name: containerFile}
+	defer c.Close()
+	if err := c.refresh(); err != nil {
+		return err
+	}
+	if len(c.segments) == 0 {
+		c.segments = append(c.segments, &segment{name: containerFile})
+	}
+	return fn(c)
+}
+
+// appendToContainer lets the container writer append the entries from write to the end of it.
+func appendToContainer(containerFile string, write func(tw *tar.Writer) error) error {
+	return queueWrite(containerFile, func(c *container) error {
+		return c.appendEntries(write)
+	})
+}
+
+// ContainersInRange returns the containers of the hour folders from the hour of
+// from up to the hour of to. With EXTEND_LIFE_SUPPORT the folders up to 127
+// months later are listed as well, extended life v4 blobs are stored there.
+func ContainersInRange(from time.Time, to time.Time) ([]string, error) {
+	var containers []string
+	seen := make(map[string]bool)
+	months := 0
+	if config.Settings.Get(config.EXTEND_LIFE_SUPPORT) == "true" {
+		months = 0x7f
+	}
+	from = from.In(LayoutLocation())
+	start := time.Date(from.Year(), from.Month(), from.Day(), from.Hour(), 0, 0, 0, from.Location())
+	for hour := start; !hour.After(to); hour = hour.Add(time.Hour) {
+		for keep := 0; keep <= months; keep++ {
+			folder := CONTAINER_ROOT + "/" + hour.AddDate(0, keep, 0).Format("2006/01/02/15")
+			err := folderContainers(folder, func(containerFile string) {
+				if !seen[containerFile] {
+					seen[containerFile] = true
+					containers = append(containers, containerFile)
+				}
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return containers, nil
+}
+
+// folderContainers calls fn with the base containers of the hour folder,
+// tiered ones included.
+func folderContainers(folder string, fn func(containerFile string)) error {
+	var names []string
+	err := Containers.List(folder, func(name string) error {
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// Hour folders hold the containers, or minute folders for sub-hour layouts
+	for _, pattern := range []string{"/*.tar", "/[0-9][0-9]/*.tar"} {
+		for _, name := range names {
+			if ok, _ := path.Match(folder+pattern, name); ok {
+				fn(BaseContainer(name))
+			}
+		}
+		// Tiered containers only left their catalog
+		tiered, err := filepath.Glob(catalogFile(folder + pattern))
+		if err != nil {
+			return err
+		}
+		for _, catalog := range tiered {
+			fn(BaseContainer(strings.TrimSuffix(strings.TrimPrefix(catalog, tieringFolder()+"/"), ".json")))
+		}
+	}
+	return nil
+}
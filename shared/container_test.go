@@ -0,0 +1,77 @@
+package shared
+
+import (
+	"bytes"
+	"fmt"
+	"glacier/config"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestContainerRollover(t *testing.T) {
+	memoryContainers(t)
+	t.Cleanup(config.Settings.Override(config.MAX_CONTAINER_SIZE, "1"))
+	test_uuid := GenerateTimeUUID()
+
+	// Ids sharing the container of test_uuid, each with more than half the max size
+	var ids []string
+	blobs := make(map[string][]byte)
+	for i := 0; i < 3; i++ {
+		id := test_uuid[:24] + fmt.Sprintf("%04x", i) + test_uuid[28:]
+		data := make([]byte, 700<<10)
+		rand.Read(data)
+		if _, err := UploadVariant("", id, "", data); err != nil {
+			t.Fatalf("Upload failed! Error:%v", err)
+		}
+		ids = append(ids, id)
+		blobs[id] = data
+	}
+
+	containerFile, _, _ := GetContainerFile(test_uuid)
+	if _, err := Containers.Size(segmentName(containerFile, 1)); err != nil {
+		t.Fatalf("Container did not roll over! Error:%v", err)
+	}
+	if size, _ := Containers.Size(containerFile); size > 2<<20 {
+		t.Fatalf("Container grew beyond max size! Have:%v", size)
+	}
+
+	if err := DeleteBlob("", ids[2]); err != nil {
+		t.Fatalf("Unable to delete file! Error:%v", err)
+	}
+	if err := CompactContainer(containerFile); err != nil {
+		t.Fatalf("Compaction failed! Error:%v", err)
+	}
+	for i, id := range ids {
+		data, _, err := ReadBlob(id, "", "")
+		if i == 2 {
+			if err != ErrNotFound {
+				t.Fatalf("Deleted file still readable! Error:%v", err)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(data, blobs[id]) {
+			t.Fatalf("Wrong content from segment! Have:%d bytes Error:%v", len(data), err)
+		}
+	}
+	if _, err := Containers.Size(segmentName(containerFile, 2)); !os.IsNotExist(err) {
+		t.Fatalf("Segment of the deleted blob left! Error:%v", err)
+	}
+}
+
+func TestReadWhileLocked(t *testing.T) {
+	memoryContainers(t)
+	test_uuid := GenerateTimeUUID()
+	testUpload(t, test_uuid, "", "read while locked "+test_uuid)
+
+	containerFile, _, _ := GetContainerFile(test_uuid)
+	unlock, err := Containers.Lock(containerFile)
+	if err != nil {
+		t.Fatalf("Unable to lock container! Error:%v", err)
+	}
+	defer unlock()
+	data, _, err := ReadBlob(test_uuid, "", "")
+	if err != nil || string(data) != "read while locked "+test_uuid {
+		t.Fatalf("Read blocked by write-lock! Have:\"%v\" Error:%v", string(data), err)
+	}
+}
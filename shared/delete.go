@@ -0,0 +1,304 @@
+package shared
+
+import (
+	"archive/tar"
+	"fmt"
+	"glacier/config"
+	"glacier/keyindex"
+	"glacier/prometheus"
+	"glacier/store"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Marker file placed next to a container holding tombstones, picked up by the compactor
+const COMPACT_MARKER = ".compact"
+
+func DeleteFile(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		fmt.Println("id is missing in parameters")
+	}
+	token, ok := vars["token"]
+	if !ok {
+		fmt.Println("token is missing in parameters")
+	}
+	err := deleteBlob(token, id, !Replicated(r))
+	if err == ErrAccessDenied {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintln(w, "Access forbidden")
+		return
+	}
+	if err == ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintln(w, "File not found")
+		return
+	}
+	if err == ErrTiered {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintln(w, err)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteBlob appends a tombstone for id to its container. The blob content is
+// removed from disk when the compactor rewrites the container.
+func DeleteBlob(token string, id string) error {
+	return deleteBlob(token, id, true)
+}
+
+// deleteBlob deletes the blob, and notifies the commit when replicate is set.
+func deleteBlob(token string, id string, replicate bool) error {
+	if config.Settings.Has(config.WRITE_TOKEN) && token != config.Settings.Get(config.WRITE_TOKEN) {
+		return ErrAccessDenied
+	}
+	containerFile, uuid_id, err := GetContainerFile(id)
+	if err != nil {
+		return err
+	}
+	// A tombstone would not reach the tiered copy
+	tiered, err := tieredBlob(containerFile, uuid_id)
+	if err != nil {
+		return err
+	}
+	if tiered {
+		return ErrTiered
+	}
+	if segments, err := segmentFiles(containerFile); err != nil || len(segments) == 0 {
+		return ErrNotFound
+	}
+	err = queueWrite(containerFile, func(c *container) error {
+		if _, err := findEntry(c, uuid_id, "", ""); err != nil {
+			return err
+		}
+		return c.appendEntries(func(tw *tar.Writer) error {
+			return tw.WriteHeader(&tar.Header{
+				Name:       uuid_id,
+				Format:     tar.FormatPAX,
+				Uname:      id,
+				PAXRecords: map[string]string{PAX_TOMBSTONE: "true"},
+			})
+		})
+	})
+	if err != nil {
+		return err
+	}
+	invalidateBlob(uuid_id)
+	if replicate {
+		notifyCommit(Commit{Op: COMMIT_DELETE, UUID: uuid_id})
+	}
+	prometheus.DeleteProcessed.Inc()
+	if err := Containers.Put(containerFile+COMPACT_MARKER, strings.NewReader(""), 0); err != nil {
+		fmt.Println("unable to create compact marker:", err)
+	}
+	return nil
+}
+
+// CompactContainer rewrites the container segments without the entries deleted
+// by a tombstone. The last tombstone of an id is kept, so a deleted blob is
+// never fetched from a fallback peer.
+func CompactContainer(containerFile string) error {
+	err := withLockedContainer(containerFile, func(c *container) error {
+		lastTombstone := make(map[string]int)
+		var names []string
+		err := c.scan(func(entry containerEntry) error {
+			if isTombstone(entry.hdr) {
+				lastTombstone[entry.hdr.Name] = len(names)
+			}
+			names = append(names, entry.hdr.Name)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		dropped := 0
+		for index, name := range names {
+			if last, deleted := lastTombstone[name]; deleted && index < last {
+				dropped++
+			}
+		}
+		if dropped == 0 {
+			return nil
+		}
+		return c.rewrite(func(index int, hdr *tar.Header) bool {
+			last, deleted := lastTombstone[hdr.Name]
+			return !deleted || index >= last
+		})
+	})
+	if err != nil {
+		return err
+	}
+	prometheus.CompactedContainers.Inc()
+	return Containers.Delete(containerFile + COMPACT_MARKER)
+}
+
+// rewriteContainer replaces the locked segment read by reader with the
+// entries accepted by keep, removing the segment when no entries are left.
+// It returns the number of entries the segment had.
+func rewriteContainer(segmentFile string, reader store.Reader, keep func(index int, hdr *tar.Header) bool) (int, error) {
+	count := 0
+	kept := 0
+	err := scanContainer(reader, func(hdr *tar.Header, offset int64) error {
+		if keep(count, hdr) {
+			kept++
+		}
+		count++
+		return nil
+	})
+	if err != nil || kept == count {
+		return count, err
+	}
+	// Readers keep the replaced segment open, the new segment is committed as a whole
+	defer forgetCommitted(segmentFile)
+	defer invalidateBlobsIn(BaseContainer(segmentFile))
+	_, err = Containers.Size(segmentFile + SEAL_INDEX)
+	sealed := err == nil
+	if err := Containers.Delete(segmentFile + SEAL_INDEX); err != nil {
+		return count, err
+	}
+	if kept == 0 {
+		return count, Containers.Delete(segmentFile)
+	}
+	err = Containers.Rewrite(segmentFile, func(tw *tar.Writer) error {
+		index := 0
+		return scanContainer(reader, func(hdr *tar.Header, offset int64) error {
+			current := index
+			index++
+			if !keep(current, hdr) {
+				return nil
+			}
+			return copyEntry(tw, reader, hdr, offset)
+		})
+	})
+	if err != nil || !sealed {
+		return count, err
+	}
+	// The kept entries stay sorted, a sealed segment is indexed again and stays read-only
+	_, err = indexSegment(segmentFile)
+	return count, err
+}
+
+// RemoveSegment deletes a segment of a container, e.g. to free space. The
+// lock of the container guards all its segments.
+func RemoveSegment(segmentFile string) error {
+	unlock, err := Containers.Lock(BaseContainer(segmentFile))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	defer forgetCommitted(segmentFile)
+	defer invalidateBlobsIn(BaseContainer(segmentFile))
+	var removed []string
+	if keyindex.Enabled() {
+		if removed, err = segmentNames(segmentFile); err != nil {
+			return err
+		}
+	}
+	if err := Containers.Delete(segmentFile + SEAL_INDEX); err != nil {
+		return err
+	}
+	if err := Containers.Delete(segmentFile); err != nil {
+		return err
+	}
+	if err := removeKeys(BaseContainer(segmentFile), removed); err != nil {
+		return err
+	}
+	// The manifest of the hour drops the container with its last segment
+	return refreshManifest(BaseContainer(segmentFile))
+}
+
+// segmentNames returns the UUIDs of the entries of the segment.
+func segmentNames(segmentFile string) ([]string, error) {
+	reader, err := Containers.Reader(segmentFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	var names []string
+	err = scanContainer(reader, func(hdr *tar.Header, offset int64) error {
+		names = append(names, hdr.Name)
+		return nil
+	})
+	return names, err
+}
+
+// removeKeys removes the S3 keys of the removed UUIDs no longer stored in
+// the container from the key index.
+func removeKeys(containerFile string, removed []string) error {
+	if len(removed) == 0 {
+		return nil
+	}
+	stored := make(map[string]bool)
+	c, err := openContainer(containerFile)
+	if err == nil {
+		err = c.scan(func(entry containerEntry) error {
+			stored[entry.hdr.Name] = true
+			return nil
+		})
+		c.Close()
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var gone []string
+	for _, id := range removed {
+		if !stored[id] {
+			gone = append(gone, id)
+		}
+	}
+	return keyindex.RemoveUUIDs(gone)
+}
+
+// ContainerExists reports if the container of the UUID still has segments or
+// tiered entries. Errors count as existing.
+func ContainerExists(id string) bool {
+	containerFile, _, err := GetContainerFile(id)
+	if err != nil {
+		return false
+	}
+	if segments, err := segmentFiles(containerFile); err != nil || len(segments) > 0 {
+		return true
+	}
+	catalog, err := loadCatalog(containerFile)
+	return err != nil || catalog != nil
+}
+
+// copyEntry writes the entry of f at offset unchanged to tw
+func copyEntry(tw *tar.Writer, f io.ReaderAt, hdr *tar.Header, offset int64) error {
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := io.Copy(tw, io.NewSectionReader(f, offset, hdr.Size))
+	return err
+}
+
+// CompactPending compacts every container under folder flagged by a compact marker.
+func CompactPending(folder string) error {
+	return Containers.List(folder, func(name string) error {
+		if !strings.HasSuffix(name, COMPACT_MARKER) {
+			return nil
+		}
+		containerFile := strings.TrimSuffix(name, COMPACT_MARKER)
+		if segments, err := segmentFiles(containerFile); err == nil && len(segments) == 0 {
+			return Containers.Delete(name)
+		}
+		if err := CompactContainer(containerFile); err != nil {
+			fmt.Println("compact failed:", containerFile, err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,43 @@
+package shared
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestDelete(t *testing.T) {
+	memoryContainers(t)
+	server := testServer(t)
+	test_uuid := GenerateTimeUUID()
+	kept_uuid := test_uuid[:24] + "0000" + test_uuid[28:]
+	data := "this blob is deleted: " + test_uuid
+	testUpload(t, test_uuid, "", data)
+	testUpload(t, kept_uuid, "", "this blob is kept")
+
+	if status, body := testRequest(t, "DELETE", server.URL+"/get/"+test_uuid, nil); status != http.StatusNoContent {
+		t.Fatalf("Wrong delete response-code! Have:%v \"%v\"", status, body)
+	}
+	if status, _ := testRequest(t, "GET", server.URL+"/get/"+test_uuid, nil); status != http.StatusNotFound {
+		t.Fatalf("Deleted file still readable! Have:%v", status)
+	}
+
+	containerFile, _, _ := GetContainerFile(test_uuid)
+	if err := CompactContainer(containerFile); err != nil {
+		t.Fatalf("Compaction failed! Error:%v", err)
+	}
+	reader, err := Containers.Reader(containerFile)
+	if err != nil {
+		t.Fatalf("Unable to read container! Error:%v", err)
+	}
+	content, _ := ioutil.ReadAll(io.NewSectionReader(reader, 0, reader.Size()))
+	reader.Close()
+	if bytes.Contains(content, []byte(data)) {
+		t.Fatalf("Deleted data still present in %v after compaction", containerFile)
+	}
+	if status, body := testRequest(t, "GET", server.URL+"/get/"+kept_uuid, nil); body != "this blob is kept" {
+		t.Fatalf("Kept blob lost by compaction! Have:%v \"%v\"", status, body)
+	}
+}
@@ -0,0 +1,120 @@
+package shared
+
+import (
+	"bytes"
+	"fmt"
+	"glacier/config"
+	"glacier/prometheus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Header of reads sent to fallback peers, the peer answers from its own
+// containers without asking its fallback peers in turn
+const NO_FALLBACK_HEADER = "X-Glacier-No-Fallback"
+
+// fallbackPeers returns the base URLs of the Glacier servers asked for blobs missing locally.
+func fallbackPeers() []string {
+	var peers []string
+	for _, peer := range strings.Split(config.Settings.Get(config.READ_FALLBACK_PEERS), ";") {
+		if peer = strings.TrimRight(strings.TrimSpace(peer), "/"); peer != "" {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// fallbackClient returns the client of fallback reads, a stalled peer fails
+// after READ_FALLBACK_TIMEOUT and the next peer is asked.
+func fallbackClient() *http.Client {
+	timeout, err := strconv.Atoi(config.Settings.Get(config.READ_FALLBACK_TIMEOUT))
+	if err != nil || timeout < 1 {
+		timeout = 300
+	}
+	return &http.Client{Timeout: time.Duration(timeout) * time.Second}
+}
+
+// deletedIn reports if the last entry of id in the container is a tombstone.
+func deletedIn(c *container, id string) bool {
+	deleted := false
+	c.scan(func(entry containerEntry) error {
+		if entry.hdr.Name == id {
+			deleted = isTombstone(entry.hdr)
+		}
+		return nil
+	})
+	return deleted
+}
+
+// fetchFromPeer writes the blob from the first peer holding it to w, and
+// stores it locally again when READ_FALLBACK_REPAIR is enabled. It returns
+// false, without writing, when no peer has the blob or the request came from
+// a peer.
+func fetchFromPeer(w http.ResponseWriter, r *http.Request, id string, variant string) bool {
+	if r.Header.Get(NO_FALLBACK_HEADER) == "true" {
+		return false
+	}
+	tokenPath := ""
+	if config.Settings.Has(config.READ_FALLBACK_TOKEN) {
+		tokenPath = url.PathEscape(config.Settings.Get(config.READ_FALLBACK_TOKEN)) + "/"
+	}
+	query := url.Values{}
+	if variant != "" {
+		query.Set("variant", variant)
+	}
+	if versionId := r.URL.Query().Get("versionId"); versionId != "" {
+		query.Set("versionId", versionId)
+	}
+	for _, peer := range fallbackPeers() {
+		target := peer + "/get/" + tokenPath + id
+		if len(query) > 0 {
+			target += "?" + query.Encode()
+		}
+		req, err := http.NewRequest("GET", target, nil)
+		if err != nil {
+			fmt.Println("fallback failed:", peer, err)
+			continue
+		}
+		req.Header.Set(NO_FALLBACK_HEADER, "true")
+		resp, err := fallbackClient().Do(req)
+		if err != nil {
+			fmt.Println("fallback failed:", peer, err)
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			continue
+		}
+		prometheus.FallbackReads.Inc()
+		for _, header := range []string{"Content-Type", "x-amz-version-id"} {
+			if value := resp.Header.Get(header); value != "" {
+				w.Header().Set(header, value)
+			}
+		}
+		if config.Settings.Get(config.READ_FALLBACK_REPAIR) != "true" {
+			io.Copy(w, resp.Body)
+			resp.Body.Close()
+			return true
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			fmt.Println("fallback failed:", peer, err)
+			continue
+		}
+		io.Copy(w, bytes.NewReader(data))
+		// The peers already hold the blob
+		if _, err := uploadVariant(config.Settings.Get(config.WRITE_TOKEN), id, variant, data, false); err != nil {
+			fmt.Println("fallback repair failed:", id, err)
+		} else {
+			prometheus.FallbackRepairs.Inc()
+		}
+		return true
+	}
+	return false
+}
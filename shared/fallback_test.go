@@ -0,0 +1,98 @@
+package shared
+
+import (
+	"glacier/config"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// testPeer serves id with data like a fallback peer and counts its reads.
+func testPeer(t *testing.T, id string, data string) (*httptest.Server, func() int) {
+	var mutex sync.Mutex
+	reads := 0
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		reads++
+		mutex.Unlock()
+		if r.Header.Get(NO_FALLBACK_HEADER) != "true" {
+			t.Errorf("Fallback read without %v", NO_FALLBACK_HEADER)
+		}
+		if r.URL.Path != "/get/"+id {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, data)
+	}))
+	t.Cleanup(peer.Close)
+	t.Cleanup(config.Settings.Override(config.READ_FALLBACK_PEERS, peer.URL))
+	return peer, func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return reads
+	}
+}
+
+func TestReadFallback(t *testing.T) {
+	memoryContainers(t)
+	test_uuid := GenerateTimeUUID()
+	data := "stored on the peer " + test_uuid
+	peer, peerReads := testPeer(t, test_uuid, data)
+	t.Cleanup(config.Settings.Override(config.READ_FALLBACK_REPAIR, "true"))
+	var mutex sync.Mutex
+	commits := 0
+	OnCommit = func(commit Commit) {
+		mutex.Lock()
+		commits++
+		mutex.Unlock()
+	}
+	defer func() { OnCommit = nil }()
+	server := testServer(t)
+
+	if status, body := testRequest(t, "GET", server.URL+"/get/"+test_uuid, nil); body != data {
+		t.Fatalf("Blob not fetched from peer! Have:%v \"%v\"", status, body)
+	}
+
+	// Reads of a peer are not forwarded to the fallback peers again
+	header := http.Header{}
+	header.Set(NO_FALLBACK_HEADER, "true")
+	if status, _ := testRequest(t, "GET", server.URL+"/get/"+GenerateTimeUUID(), header); status == http.StatusOK || peerReads() != 1 {
+		t.Fatalf("Peer read forwarded! Have:%v %d reads", status, peerReads())
+	}
+
+	// The repaired blob is served locally without the peer
+	peer.Close()
+	if status, body := testRequest(t, "GET", server.URL+"/get/"+test_uuid, nil); body != data {
+		t.Fatalf("Blob not repaired! Have:%v \"%v\"", status, body)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if commits != 0 {
+		t.Fatalf("Repaired blob replicated! Have:%d commits", commits)
+	}
+}
+
+func TestReadFallbackCompacted(t *testing.T) {
+	memoryContainers(t)
+	server := testServer(t)
+	test_uuid := GenerateTimeUUID()
+	testUpload(t, test_uuid, "", "deleted locally")
+	if status, body := testRequest(t, "DELETE", server.URL+"/get/"+test_uuid, nil); status != http.StatusNoContent {
+		t.Fatalf("Wrong delete response-code! Have:%v \"%v\"", status, body)
+	}
+	containerFile, _, _ := GetContainerFile(test_uuid)
+	if err := CompactContainer(containerFile); err != nil {
+		t.Fatalf("Compaction failed! Error:%v", err)
+	}
+
+	_, peerReads := testPeer(t, test_uuid, "still stored on the peer")
+	if status, body := testRequest(t, "GET", server.URL+"/get/"+test_uuid, nil); status != http.StatusNotFound {
+		t.Fatalf("Compacted blob fetched from peer! Have:%v \"%v\"", status, body)
+	}
+	if peerReads() != 0 {
+		t.Fatalf("Peer asked for a deleted blob! Have:%d reads", peerReads())
+	}
+}
@@ -0,0 +1,72 @@
+package shared
+
+import (
+	"glacier/config"
+	"glacier/store"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestMain(m *testing.M) {
+	config.Settings.Init()
+	os.Exit(m.Run())
+}
+
+// memoryContainers keeps the containers of the test in memory and its data
+// folder in a temporary folder, both dropped when the test ends.
+func memoryContainers(t *testing.T) {
+	t.Cleanup(config.Settings.Override(config.DATA_FOLDER, t.TempDir()))
+	containers := Containers
+	Containers = store.NewMemory(1 << 30)
+	t.Cleanup(func() {
+		FlushManifests()
+		Containers = containers
+		committed.Lock()
+		committed.m = make(map[string]int64)
+		committed.Unlock()
+		blobCache.Lock()
+		for blobCache.lru.Len() > 0 {
+			removeCachedBlob(blobCache.lru.Front())
+		}
+		blobCache.Unlock()
+	})
+}
+
+// testServer serves the blob handlers of the package like the main router.
+func testServer(t *testing.T) *httptest.Server {
+	r := mux.NewRouter()
+	r.HandleFunc("/get/{id}", DeleteFile).Methods("DELETE")
+	r.HandleFunc("/get/{id}", GetFile)
+	r.HandleFunc("/batch", BatchGet).Methods("POST")
+	r.HandleFunc("/api/list", ListBlobs)
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// testUpload stores data as the variant of id.
+func testUpload(t *testing.T, id string, variant string, data string) {
+	if _, err := UploadVariant("", id, variant, []byte(data)); err != nil {
+		t.Fatalf("Upload of %v failed! Error:%v", id, err)
+	}
+}
+
+// testRequest sends a request to the server and returns the status and body.
+func testRequest(t *testing.T, method string, url string, header http.Header) (int, string) {
+	req, _ := http.NewRequest(method, url, nil)
+	for key := range header {
+		req.Header.Set(key, header.Get(key))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%v %v failed! Error:%v", method, url, err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
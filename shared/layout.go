@@ -0,0 +1,163 @@
+package shared
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"glacier/config"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofrs/flock"
+)
+
+// Layout describes how blobs written from From are sharded into containers.
+type Layout struct {
+	From          time.Time
+	Shards        int // 16, 256 or 4096 containers per folder
+	FolderMinutes int // 60 for hour folders, or a divisor of 60 for YYYY/MM/DD/HH/MM folders
+}
+
+// Layout used by data written before the layout descriptor existed
+var defaultLayout = Layout{Shards: 256, FolderMinutes: 60}
+
+var layouts = struct {
+	sync.RWMutex
+	list []Layout
+}{list: []Layout{defaultLayout}}
+
+// Layout descriptor file in DATA_FOLDER
+const LAYOUT_FILE = "layout.json"
+
+// Lock file in DATA_FOLDER, shared by running servers and held alone by the
+// migrate-layout and rebuild-manifests commands
+const DATA_LOCK = "glacier.lock"
+
+var ErrDataFolderInUse = errors.New("data folder in use")
+
+// LockDataFolder takes the lock of DATA_FOLDER, exclusive for commands that
+// rewrite containers. Reads of the server skip the container lock, so these
+// commands and servers never run on the same data folder.
+func LockDataFolder(exclusive bool) (func(), error) {
+	folder := config.Settings.Get(config.DATA_FOLDER)
+	if err := os.MkdirAll(folder, 0700); err != nil {
+		return nil, err
+	}
+	fileLock := flock.New(filepath.Join(folder, DATA_LOCK))
+	var locked bool
+	var err error
+	if exclusive {
+		locked, err = fileLock.TryLock()
+	} else {
+		locked, err = fileLock.TryRLock()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !locked {
+		return nil, ErrDataFolderInUse
+	}
+	return func() { fileLock.Unlock() }, nil
+}
+
+// shardDigits returns the number of hex digits naming the containers of the layout
+func (layout Layout) shardDigits() int {
+	switch layout.Shards {
+	case 16:
+		return 1
+	case 4096:
+		return 3
+	}
+	return 2
+}
+
+// folder returns the YYYY/MM/DD/HH folder, with a minute level for sub-hour layouts
+func (layout Layout) folder(timestamp time.Time) string {
+	folder := timestamp.Format("2006/01/02/15")
+	if layout.FolderMinutes < 60 {
+		folder += fmt.Sprintf("/%02d", timestamp.Minute()/layout.FolderMinutes*layout.FolderMinutes)
+	}
+	return folder
+}
+
+func validLayout(layout Layout) error {
+	if layout.Shards != 16 && layout.Shards != 256 && layout.Shards != 4096 {
+		return errors.New("CONTAINER_SHARDS must be 16, 256 or 4096")
+	}
+	if layout.FolderMinutes < 1 || layout.FolderMinutes > 60 || 60%layout.FolderMinutes != 0 {
+		return errors.New("FOLDER_MINUTES must be a divisor of 60")
+	}
+	return nil
+}
+
+// layoutAt returns the layout used for blobs written at timestamp
+func layoutAt(timestamp time.Time) Layout {
+	layouts.RLock()
+	defer layouts.RUnlock()
+	layout := layouts.list[0]
+	for _, next := range layouts.list[1:] {
+		if timestamp.Before(next.From) {
+			break
+		}
+		layout = next
+	}
+	return layout
+}
+
+// LoadLayout reads the layout descriptor from DATA_FOLDER and records a new
+// layout from now when CONTAINER_SHARDS or FOLDER_MINUTES changed, so data
+// written under earlier layouts is still found.
+func LoadLayout() error {
+	current := Layout{}
+	var err error
+	if current.Shards, err = strconv.Atoi(config.Settings.Get(config.CONTAINER_SHARDS)); err != nil {
+		return err
+	}
+	if current.FolderMinutes, err = strconv.Atoi(config.Settings.Get(config.FOLDER_MINUTES)); err != nil {
+		return err
+	}
+	if err := validLayout(current); err != nil {
+		return err
+	}
+
+	descriptor := filepath.Join(config.Settings.Get(config.DATA_FOLDER), LAYOUT_FILE)
+	list := []Layout{defaultLayout}
+	data, err := ioutil.ReadFile(descriptor)
+	if err == nil {
+		if err := json.Unmarshal(data, &list); err != nil {
+			return fmt.Errorf("%v: %v", descriptor, err)
+		}
+		if len(list) == 0 {
+			list = []Layout{defaultLayout}
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	last := list[len(list)-1]
+	if last.Shards != current.Shards || last.FolderMinutes != current.FolderMinutes {
+		// v4 time-UUIDs have minute precision, so switch at the next whole minute
+		current.From = time.Now().UTC().Truncate(time.Minute).Add(time.Minute)
+		list = append(list, current)
+		fmt.Printf("Layout changed from %d/%dmin to %d/%dmin\n", last.Shards, last.FolderMinutes, current.Shards, current.FolderMinutes)
+	}
+	data, err = json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(descriptor+".tmp", data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(descriptor+".tmp", descriptor); err != nil {
+		return err
+	}
+
+	layouts.Lock()
+	layouts.list = list
+	layouts.Unlock()
+	return nil
+}
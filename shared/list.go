@@ -0,0 +1,178 @@
+package shared
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"glacier/config"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type BlobInfo struct {
+	UUID          string
+	ContainerFile string
+	Size          int64
+	RealSize      int64
+	MimeType      string
+	Compressed    bool
+	Metadata      map[string]string
+}
+
+type BlobList struct {
+	Blobs      []BlobInfo
+	NextCursor string `json:",omitempty"`
+}
+
+// cursors point after the last blob listed as "containerFile:UUID", blobs of
+// a container are listed in UUID order so compaction does not move the cursor
+func encodeCursor(containerFile string, id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(containerFile + ":" + id))
+}
+
+func decodeCursor(cursor string) (string, string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", "", err
+	}
+	sep := strings.LastIndex(string(raw), ":")
+	if sep < 0 {
+		return "", "", fmt.Errorf("invalid cursor")
+	}
+	return string(raw[:sep]), string(raw[sep+1:]), nil
+}
+
+// inTimeRange reports if the time of the UUID is between from and to.
+func inTimeRange(id string, from time.Time, to time.Time) bool {
+	timestamp, err := GetUUIDTime(id)
+	return err == nil && !timestamp.Before(from) && !timestamp.After(to)
+}
+
+// ListBlobs returns the blobs whose UUID time is between from and to as JSON.
+func ListBlobs(w http.ResponseWriter, r *http.Request) {
+	token := mux.Vars(r)["token"]
+	if config.Settings.Has(config.READ_TOKEN) && token != config.Settings.Get(config.READ_TOKEN) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintln(w, "Access forbidden")
+		return
+	}
+	query := r.URL.Query()
+	to := time.Now()
+	from := to.Add(-time.Hour)
+	var err error
+	if query.Get("from") != "" {
+		if from, err = time.Parse(time.RFC3339, query.Get("from")); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, "from:", err)
+			return
+		}
+	}
+	if query.Get("to") != "" {
+		if to, err = time.Parse(time.RFC3339, query.Get("to")); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, "to:", err)
+			return
+		}
+	}
+	limit := 1000
+	if query.Get("limit") != "" {
+		if limit, err = strconv.Atoi(query.Get("limit")); err != nil || limit < 1 || limit > 10000 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, "limit must be 1-10000")
+			return
+		}
+	}
+	startContainer, startUUID := "", ""
+	if query.Get("cursor") != "" {
+		if startContainer, startUUID, err = decodeCursor(query.Get("cursor")); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, "cursor:", err)
+			return
+		}
+	}
+	mime := query.Get("mime")
+
+	containers, err := ContainersInRange(from, to)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, err)
+		return
+	}
+	sort.Strings(containers)
+
+	result := BlobList{Blobs: []BlobInfo{}}
+	for _, containerFile := range containers {
+		if containerFile < startContainer {
+			continue
+		}
+		blobs, err := listContainer(containerFile)
+		if err != nil {
+			fmt.Println("list failed:", containerFile, err)
+			continue
+		}
+		sort.Slice(blobs, func(i, j int) bool { return blobs[i].UUID < blobs[j].UUID })
+		for _, blob := range blobs {
+			if containerFile == startContainer && blob.UUID <= startUUID {
+				continue
+			}
+			if !inTimeRange(blob.UUID, from, to) {
+				continue
+			}
+			if mime != "" && !strings.HasPrefix(blob.MimeType, mime) {
+				continue
+			}
+			if len(result.Blobs) == limit {
+				last := result.Blobs[len(result.Blobs)-1]
+				result.NextCursor = encodeCursor(last.ContainerFile, last.UUID)
+				break
+			}
+			result.Blobs = append(result.Blobs, blob)
+		}
+		if result.NextCursor != "" {
+			break
+		}
+	}
+	jData, err := json.Marshal(result)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jData)
+}
+
+// listContainer returns the visible blobs of a container in the order they were written.
+func listContainer(containerFile string) ([]BlobInfo, error) {
+	c, err := openContainer(containerFile)
+	if err != nil {
+		return nil, err
+	}
+	entries, order, err := collectEntries(c, "", func(id string) bool { return true })
+	c.Close()
+	if err != nil {
+		return nil, err
+	}
+	blobs := make([]BlobInfo, 0, len(order))
+	for _, id := range order {
+		entry, err := selectEntry(entries[id], "")
+		if err != nil {
+			continue
+		}
+		blobs = append(blobs, BlobInfo{
+			UUID:          id,
+			ContainerFile: containerFile,
+			Size:          entry.hdr.Size,
+			RealSize:      entry.realSize(),
+			MimeType:      entry.hdr.Gname,
+			Compressed:    entry.hdr.Mode != 0,
+			Metadata:      entry.hdr.PAXRecords,
+		})
+	}
+	return blobs, nil
+}
@@ -0,0 +1,92 @@
+package shared
+
+import (
+	"encoding/json"
+	"glacier/config"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// testList returns the blobs listed by the query, following the cursor.
+func testList(t *testing.T, server string, query string) map[string]bool {
+	listed := make(map[string]bool)
+	cursor := ""
+	for pages := 0; pages < 1000; pages++ {
+		_, body := testRequest(t, "GET", server+"/api/list?limit=2&"+query+"&cursor="+cursor, nil)
+		var list BlobList
+		if err := json.Unmarshal([]byte(body), &list); err != nil {
+			t.Fatalf("Unable to decode list! Have:\"%v\" Error:%v", body, err)
+		}
+		if len(list.Blobs) > 2 {
+			t.Fatalf("List ignored limit! Have:%v", len(list.Blobs))
+		}
+		for _, blob := range list.Blobs {
+			listed[blob.UUID] = true
+		}
+		if list.NextCursor == "" {
+			break
+		}
+		cursor = list.NextCursor
+	}
+	return listed
+}
+
+func TestList(t *testing.T) {
+	memoryContainers(t)
+	server := testServer(t)
+	var ids []string
+	for i := 0; i < 3; i++ {
+		test_uuid := GenerateTimeUUID()
+		ids = append(ids, test_uuid)
+		testUpload(t, test_uuid, "", "list blob")
+	}
+
+	// Time-UUIDs carry the minute of the upload
+	from := url.QueryEscape(time.Now().Add(-2 * time.Minute).Format(time.RFC3339))
+	to := url.QueryEscape(time.Now().Add(time.Minute).Format(time.RFC3339))
+	listed := testList(t, server.URL, "from="+from+"&to="+to)
+	for _, id := range ids {
+		if !listed[id] {
+			t.Fatalf("Blob %v missing from list: %v", id, listed)
+		}
+	}
+
+	// The range is applied to every blob, not only to its hour folder
+	test_uuid := GenerateTimeUUID()
+	early := "20200105-1300-" + test_uuid[14:]
+	late := "20200105-1345-" + test_uuid[14:24] + "0000" + test_uuid[28:]
+	for _, id := range []string{early, late} {
+		testUpload(t, id, "", "ranged blob")
+	}
+	listed = testList(t, server.URL, "from=2020-01-05T13:30:00Z&to=2020-01-05T14:00:00Z")
+	if listed[early] || !listed[late] {
+		t.Fatalf("Wrong blobs in range! Have:%v", listed)
+	}
+}
+
+func TestContainersInRange(t *testing.T) {
+	memoryContainers(t)
+	t.Cleanup(config.Settings.Override(config.EXTEND_LIFE_SUPPORT, "true"))
+	test_uuid := GenerateTimeUUID()
+	// Stored at the hour starting at to, and 3 months later by extended life
+	edge := "20200106-1400-" + test_uuid[14:]
+	extended := "20200106-1383-" + test_uuid[14:24] + "0000" + test_uuid[28:]
+	for _, id := range []string{edge, extended} {
+		testUpload(t, id, "", "ranged blob")
+	}
+	containers, err := ContainersInRange(time.Date(2020, 1, 6, 13, 30, 0, 0, time.UTC), time.Date(2020, 1, 6, 14, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("ContainersInRange error:%v", err)
+	}
+	for _, id := range []string{edge, extended} {
+		containerFile, _, _ := GetContainerFile(id)
+		found := false
+		for _, match := range containers {
+			found = found || match == containerFile
+		}
+		if !found {
+			t.Errorf("Container %v of %v not in range! Have:%v", containerFile, id, containers)
+		}
+	}
+}
@@ -0,0 +1,352 @@
+package shared
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+// File of an hour folder describing its containers
+const MANIFEST_FILE = "manifest.json"
+
+// Inventory counts the blobs and variants stored, deleted ones until the
+// compactor removes them.
+type Inventory struct {
+	Entries       int
+	StoredBytes   int64
+	OriginalBytes int64
+	MimeTypes     map[string]int
+	MinUUID       string
+	MaxUUID       string
+}
+
+type ContainerManifest struct {
+	Inventory
+	Checksum string // SHA-256 of the container file when sealed
+}
+
+// Manifest describes the containers of an hour folder. Sealed containers are
+// never appended to again, later writes go to new segments sealed by the next
+// run.
+type Manifest struct {
+	Folder string
+	Sealed time.Time // Last run sealing containers of the folder
+	Inventory
+	Containers map[string]*ContainerManifest
+}
+
+// Manifests changed since they were saved, saved within a second
+var manifests = struct {
+	sync.Mutex
+	changed   map[string]*Manifest
+	scheduled bool
+}{changed: make(map[string]*Manifest)}
+
+// add counts a stored entry, tombstones are not counted.
+func (inventory *Inventory) add(hdr *tar.Header) {
+	if isTombstone(hdr) {
+		return
+	}
+	mimeType := hdr.Gname
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+	inventory.merge(Inventory{
+		Entries:       1,
+		StoredBytes:   hdr.Size,
+		OriginalBytes: (&containerEntry{hdr: hdr}).realSize(),
+		MimeTypes:     map[string]int{mimeType: 1},
+		MinUUID:       hdr.Name,
+		MaxUUID:       hdr.Name,
+	})
+}
+
+// merge adds the counts of other.
+func (inventory *Inventory) merge(other Inventory) {
+	inventory.Entries += other.Entries
+	inventory.StoredBytes += other.StoredBytes
+	inventory.OriginalBytes += other.OriginalBytes
+	for mimeType, count := range other.MimeTypes {
+		if inventory.MimeTypes == nil {
+			inventory.MimeTypes = make(map[string]int)
+		}
+		inventory.MimeTypes[mimeType] += count
+	}
+	if other.MinUUID != "" && (inventory.MinUUID == "" || other.MinUUID < inventory.MinUUID) {
+		inventory.MinUUID = other.MinUUID
+	}
+	if other.MaxUUID > inventory.MaxUUID {
+		inventory.MaxUUID = other.MaxUUID
+	}
+}
+
+// HourFolder returns the hour folder holding the container, also for sub-hour layouts.
+func HourFolder(containerFile string) (string, error) {
+	folder := extractDateFromFolder.FindStringSubmatch(containerFile)
+	if folder == nil {
+		return "", errors.New("no hour folder in " + containerFile)
+	}
+	return CONTAINER_ROOT + "/" + folder[1], nil
+}
+
+// LoadManifest returns the manifest of the hour folder, empty when the folder
+// has none.
+func LoadManifest(folder string) (*Manifest, error) {
+	manifests.Lock()
+	defer manifests.Unlock()
+	if manifest, ok := manifests.changed[folder]; ok {
+		if err := manifest.save(); err != nil {
+			return nil, err
+		}
+		delete(manifests.changed, folder)
+	}
+	return loadManifest(folder)
+}
+
+func loadManifest(folder string) (*Manifest, error) {
+	manifest := &Manifest{Folder: folder, Containers: make(map[string]*ContainerManifest)}
+	size, err := Containers.Size(folder + "/" + MANIFEST_FILE)
+	if os.IsNotExist(err) {
+		return manifest, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	content, err := Containers.Open(folder+"/"+MANIFEST_FILE, 0, size)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+	data, err := ioutil.ReadAll(content)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, err
+	}
+	if manifest.Containers == nil {
+		manifest.Containers = make(map[string]*ContainerManifest)
+	}
+	return manifest, nil
+}
+
+// updateManifest changes the manifest of the hour folder holding the
+// container with fn. The caller holds the container lock, so uploads and
+// seals of the container are counted in order.
+func updateManifest(containerFile string, fn func(manifest *Manifest)) error {
+	folder, err := HourFolder(containerFile)
+	if err != nil {
+		return err
+	}
+	manifests.Lock()
+	defer manifests.Unlock()
+	manifest, ok := manifests.changed[folder]
+	if !ok {
+		if manifest, err = loadManifest(folder); err != nil {
+			return err
+		}
+		manifests.changed[folder] = manifest
+	}
+	fn(manifest)
+	if !manifests.scheduled {
+		manifests.scheduled = true
+		time.AfterFunc(time.Second, func() { FlushManifests() })
+	}
+	return nil
+}
+
+// recordUpload counts an entry appended to the container in its manifest.
+func recordUpload(containerFile string, hdr *tar.Header) error {
+	return updateManifest(containerFile, func(manifest *Manifest) {
+		container, ok := manifest.Containers[containerFile]
+		if !ok {
+			container = &ContainerManifest{}
+			manifest.Containers[containerFile] = container
+		}
+		container.add(hdr)
+	})
+}
+
+// refreshManifest counts the container again for the manifest of its folder,
+// which drops the container when it has no entries left. The caller holds
+// the container lock.
+func refreshManifest(containerFile string) error {
+	container, err := inventoryContainer(containerFile)
+	if os.IsNotExist(err) || err == nil && container.Entries == 0 {
+		return updateManifest(containerFile, func(manifest *Manifest) {
+			delete(manifest.Containers, containerFile)
+		})
+	}
+	if err != nil {
+		return err
+	}
+	return updateManifest(containerFile, func(manifest *Manifest) {
+		manifest.Containers[containerFile] = container
+	})
+}
+
+// FlushManifests saves the manifests changed since the last flush.
+func FlushManifests() error {
+	manifests.Lock()
+	defer manifests.Unlock()
+	manifests.scheduled = false
+	var err error
+	for folder, manifest := range manifests.changed {
+		if saveErr := manifest.save(); saveErr != nil {
+			fmt.Println("manifest save failed:", folder, saveErr)
+			err = saveErr
+		}
+		delete(manifests.changed, folder)
+	}
+	return err
+}
+
+// save sums up the containers and saves the manifest in its folder, or
+// removes it when the folder has no containers left.
+func (manifest *Manifest) save() error {
+	manifest.Inventory = Inventory{}
+	for _, container := range manifest.Containers {
+		manifest.merge(container.Inventory)
+	}
+	file := manifest.Folder + "/" + MANIFEST_FILE
+	if len(manifest.Containers) == 0 {
+		return Containers.Delete(file)
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return Containers.Put(file, bytes.NewReader(data), int64(len(data)))
+}
+
+// TotalInventory sums up the manifests of all hour folders below folder and
+// returns the number of manifests.
+func TotalInventory(folder string) (Inventory, int, error) {
+	if err := FlushManifests(); err != nil {
+		return Inventory{}, 0, err
+	}
+	var total Inventory
+	count := 0
+	err := Containers.List(folder, func(name string) error {
+		if path.Base(name) != MANIFEST_FILE {
+			return nil
+		}
+		manifest, err := loadManifest(path.Dir(name))
+		if err != nil {
+			return err
+		}
+		total.merge(manifest.Inventory)
+		count++
+		return nil
+	})
+	return total, count, err
+}
+
+// RebuildManifests writes the manifest of every hour folder from its
+// containers, e.g. after a crash lost the last second of uploads. Tiered
+// containers are counted from their catalog.
+func RebuildManifests() error {
+	folders := make(map[string][]string)
+	var order []string
+	seen := make(map[string]bool)
+	err := Containers.List(CONTAINER_ROOT, func(name string) error {
+		folder, err := HourFolder(name)
+		if err != nil {
+			return nil
+		}
+		if _, ok := folders[folder]; !ok {
+			folders[folder] = nil
+			order = append(order, folder)
+		}
+		containerFile := BaseContainer(name)
+		if path.Ext(name) == ".tar" && !seen[containerFile] {
+			seen[containerFile] = true
+			folders[folder] = append(folders[folder], containerFile)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := FlushManifests(); err != nil {
+		return err
+	}
+	sort.Strings(order)
+	for _, folder := range order {
+		manifest, err := loadManifest(folder)
+		if err != nil {
+			fmt.Println("manifest load failed:", folder, err)
+			manifest = &Manifest{Folder: folder}
+		}
+		containers := folders[folder]
+		for containerFile := range manifest.Containers {
+			// Tiered containers only left their catalog
+			if catalog, err := loadCatalog(containerFile); err == nil && catalog != nil && !seen[containerFile] {
+				containers = append(containers, containerFile)
+			}
+		}
+		manifest.Containers = make(map[string]*ContainerManifest)
+		for _, containerFile := range containers {
+			container, err := inventoryContainer(containerFile)
+			if err != nil {
+				fmt.Println("manifest rebuild failed:", containerFile, err)
+				continue
+			}
+			manifest.Containers[containerFile] = container
+		}
+		if err := manifest.save(); err != nil {
+			return err
+		}
+		fmt.Printf("Manifest: %v %d entries\n", folder, manifest.Entries)
+	}
+	return nil
+}
+
+// inventoryContainer counts the entries of the container segments and
+// catalog, with the checksum of the container when it is sealed.
+func inventoryContainer(containerFile string) (*ContainerManifest, error) {
+	c, err := openContainer(containerFile)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	container := &ContainerManifest{}
+	if c.catalog != nil {
+		err := scanCatalog(c.catalog, func(entry containerEntry) error {
+			container.add(entry.hdr)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range c.segments {
+		err := scanContainer(s.reader, func(hdr *tar.Header, offset int64) error {
+			container.add(hdr)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(c.segments) == 1 && c.segments[0].name == containerFile {
+		index, err := c.openIndex(containerFile, c.segments[0].reader)
+		if err != nil {
+			return nil, err
+		}
+		if index != nil {
+			if container.Checksum, err = checksumSegment(c.segments[0].reader); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return container, nil
+}
@@ -0,0 +1,72 @@
+package shared
+
+import (
+	"net/http"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	memoryContainers(t)
+	server := testServer(t)
+
+	test_uuid := GenerateTimeUUID()
+	blobs := map[string]string{
+		"20200104-0000-" + test_uuid[14:]:                             "plain text blob",
+		"20200104-0000-" + test_uuid[14:24] + "0000" + test_uuid[28:]: strings.Repeat("compressed text blob ", 20),
+		"20200104-0000-" + test_uuid[14:24] + "ffff" + test_uuid[28:]: "{\"json\": true}",
+	}
+	var original int64
+	for id, data := range blobs {
+		testUpload(t, id, "", data)
+		original += int64(len(data))
+	}
+	containerFile, _, _ := GetContainerFile("20200104-0000-" + test_uuid[14:])
+	folder := path.Dir(containerFile)
+	check := func() {
+		manifest, err := LoadManifest(folder)
+		if err != nil || manifest.Entries != 3 || manifest.OriginalBytes != original || manifest.StoredBytes >= original {
+			t.Fatalf("Wrong manifest! Have:%+v Error:%v", manifest, err)
+		}
+		if manifest.MimeTypes["text/plain; charset=utf-8"] != 2 || manifest.MimeTypes["application/json"] != 1 {
+			t.Fatalf("Wrong MIME histogram! Have:%v", manifest.MimeTypes)
+		}
+		if !strings.HasSuffix(manifest.MinUUID, "0000"+test_uuid[28:]) {
+			t.Fatalf("Wrong lowest UUID! Have:%v", manifest.MinUUID)
+		}
+		if !strings.HasSuffix(manifest.MaxUUID, "ffff"+test_uuid[28:]) {
+			t.Fatalf("Wrong highest UUID! Have:%v", manifest.MaxUUID)
+		}
+	}
+	check()
+
+	if err := Containers.Delete(folder + "/" + MANIFEST_FILE); err != nil {
+		t.Fatalf("Unable to delete manifest! Error:%v", err)
+	}
+	if err := RebuildManifests(); err != nil {
+		t.Fatalf("Rebuild failed! Error:%v", err)
+	}
+	check()
+
+	// The compactor counts the container again, without the checksum of the sealed file
+	if _, err := SealContainer(containerFile); err != nil {
+		t.Fatalf("Seal failed! Error:%v", err)
+	}
+	if status, body := testRequest(t, "DELETE", server.URL+"/get/20200104-0000-"+test_uuid[14:], nil); status != http.StatusNoContent {
+		t.Fatalf("Wrong delete response-code! Have:%v \"%v\"", status, body)
+	}
+	if err := CompactContainer(containerFile); err != nil {
+		t.Fatalf("Compact failed! Error:%v", err)
+	}
+	manifest, err := LoadManifest(folder)
+	if err != nil || manifest.Entries != 2 || manifest.Containers[containerFile] == nil || manifest.Containers[containerFile].Checksum != "" {
+		t.Fatalf("Manifest not updated by compaction! Have:%+v Error:%v", manifest, err)
+	}
+	if err := RemoveSegment(containerFile); err != nil {
+		t.Fatalf("Unable to remove container! Error:%v", err)
+	}
+	if manifest, err := LoadManifest(folder); err != nil || manifest.Entries != 0 {
+		t.Fatalf("Removed container still counted! Have:%+v Error:%v", manifest, err)
+	}
+}
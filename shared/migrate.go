@@ -0,0 +1,85 @@
+package shared
+
+import (
+	"archive/tar"
+	"fmt"
+	"path"
+)
+
+// MigrateLayout moves every entry stored in another container than the one
+// GetContainerFile maps its UUID to under the current LAYOUT_TIMEZONE, i.e. v1
+// and v7 entries written in UTC folders. v4 entries never move, their folder is
+// the wall clock time in the UUID.
+func MigrateLayout() error {
+	moved := 0
+	migrated := make(map[string]bool)
+	err := Containers.List(CONTAINER_ROOT, func(name string) error {
+		if path.Ext(name) != ".tar" {
+			return nil
+		}
+		containerFile := BaseContainer(name)
+		if migrated[containerFile] {
+			return nil
+		}
+		migrated[containerFile] = true
+		count, err := migrateContainer(containerFile)
+		if err != nil {
+			fmt.Println("migrate failed:", containerFile, err)
+			return nil
+		}
+		if count > 0 {
+			fmt.Printf("Migrate: %v moved %d entries\n", containerFile, count)
+		}
+		moved += count
+		return nil
+	})
+	fmt.Printf("Migrate: moved %d entries\n", moved)
+	if flushErr := FlushManifests(); err == nil {
+		err = flushErr
+	}
+	return err
+}
+
+func migrateContainer(containerFile string) (int, error) {
+	moved := make(map[int]bool)
+	targets := make(map[string]bool)
+	err := withLockedContainer(containerFile, func(c *container) error {
+		index := 0
+		err := c.scan(func(entry containerEntry) error {
+			hdr := entry.hdr
+			current := index
+			index++
+			target, _, err := GetContainerFile(hdr.Name)
+			if err != nil || target == containerFile {
+				return nil
+			}
+			err = appendToContainer(target, func(tw *tar.Writer) error {
+				return copyEntry(tw, entry.reader, hdr, entry.offset)
+			})
+			if err != nil {
+				return err
+			}
+			moved[current] = true
+			targets[target] = true
+			return nil
+		})
+		if len(moved) == 0 {
+			return err
+		}
+		// Drop the entries already copied, also when the scan stopped on an error
+		rewriteErr := c.rewrite(func(index int, hdr *tar.Header) bool { return !moved[index] })
+		if err != nil {
+			return err
+		}
+		return rewriteErr
+	})
+	for target := range targets {
+		refreshErr := withLockedContainer(target, func(c *container) error {
+			return refreshManifest(target)
+		})
+		if err == nil {
+			err = refreshErr
+		}
+	}
+	return len(moved), err
+}
@@ -0,0 +1,47 @@
+package shared
+
+import (
+	"glacier/config"
+	"os"
+	"testing"
+)
+
+func TestMigrateLayout(t *testing.T) {
+	memoryContainers(t)
+	t.Cleanup(config.Settings.Override(config.LAYOUT_TIMEZONE, "UTC"))
+	suffix := GenerateTimeUUID()[24:]
+	// Written at 2022-11-02 13:26 UTC, 14:26 in Copenhagen
+	ids := map[string]string{
+		"e40b2400-5ab1-11ed-8000-" + suffix: "files/2022/11/02/14/24.tar",
+		"01843885-2240-7000-8000-" + suffix: "files/2022/11/02/14/" + suffix[10:] + ".tar",
+		"20221102-1326-4897-aeed-" + suffix: "files/2022/11/02/13/" + suffix[10:] + ".tar",
+	}
+	var utcFiles []string
+	for id := range ids {
+		testUpload(t, id, "", "migrated "+id)
+		containerFile, _, _ := GetContainerFile(id)
+		utcFiles = append(utcFiles, containerFile)
+	}
+
+	config.Settings.Override(config.LAYOUT_TIMEZONE, "Europe/Copenhagen")
+	if err := MigrateLayout(); err != nil {
+		t.Fatalf("Migrate failed! Error:%v", err)
+	}
+	for id, want := range ids {
+		containerFile, _, _ := GetContainerFile(id)
+		if containerFile != want {
+			t.Errorf("GetContainerFile(%v) Want:%v Have:%v", id, want, containerFile)
+		}
+		data, _, err := ReadBlob(id, "", "")
+		if err != nil || string(data) != "migrated "+id {
+			t.Errorf("Wrong migrated content of %v! Have:\"%v\" Error:%v", id, string(data), err)
+		}
+	}
+	// Only the v4 entry is left in the UTC folders, it never moves
+	for _, containerFile := range utcFiles {
+		_, err := Containers.Size(containerFile)
+		if kept := containerFile == ids["20221102-1326-4897-aeed-"+suffix]; kept == os.IsNotExist(err) {
+			t.Errorf("Container %v kept:%v Error:%v", containerFile, kept, err)
+		}
+	}
+}
@@ -0,0 +1,382 @@
+package shared
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"glacier/config"
+	"glacier/prometheus"
+	"glacier/store"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Companion file of a sealed segment, holding the header offsets of its
+// entries sorted by name
+const SEAL_INDEX = ".idx"
+
+// An index starts with indexMagic and the length of its segment, followed by
+// one record per entry: the name padded with zero bytes to indexNameSize and
+// the offset of the entry header in the segment.
+const (
+	indexMagic      = "GLIDX001"
+	indexHeaderSize = 16
+	indexNameSize   = 64
+	indexRecordSize = indexNameSize + 8
+)
+
+var errStaleIndex = errors.New("index does not match the segment")
+
+// Values of SEAL_COMPRESSION
+const SEAL_ZSTD = "zstd"
+
+// Encoders of sealEntry, single threaded so encoding the same content twice
+// gives the same output
+var zstdEncoders = sync.Pool{New: func() interface{} {
+	encoder, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBestCompression), zstd.WithEncoderConcurrency(1))
+	return encoder
+}}
+
+// SealEnabled reports if containers of folders whose time is over are sealed,
+// and reads use the index of sealed segments.
+func SealEnabled() bool {
+	return config.Settings.Get(config.SEAL_SUPPORT) == "true"
+}
+
+// sealIndex looks the entries of a sealed segment up by name.
+type sealIndex struct {
+	reader  store.Reader
+	records int64
+}
+
+// openIndex opens the index of the segment read by reader, nil when the
+// segment is not sealed or was replaced after the index was written.
+func (c *container) openIndex(segmentFile string, reader store.Reader) (*sealIndex, error) {
+	indexReader, err := c.open(segmentFile + SEAL_INDEX)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, indexHeaderSize)
+	if _, err := indexReader.ReadAt(header, 0); err != nil {
+		return nil, nil
+	}
+	// Segments are only replaced with another length, the entries removed by
+	// the compactor or merged by the next seal
+	if string(header[:8]) != indexMagic || int64(binary.BigEndian.Uint64(header[8:])) != reader.Size() {
+		return nil, nil
+	}
+	return &sealIndex{reader: indexReader, records: (indexReader.Size() - indexHeaderSize) / indexRecordSize}, nil
+}
+
+func (index *sealIndex) record(i int64) (string, int64, error) {
+	record := make([]byte, indexRecordSize)
+	if _, err := index.reader.ReadAt(record, indexHeaderSize+i*indexRecordSize); err != nil {
+		return "", 0, err
+	}
+	return strings.TrimRight(string(record[:indexNameSize]), "\x00"), int64(binary.BigEndian.Uint64(record[indexNameSize:])), nil
+}
+
+// lookup calls fn for the entries named name of the segment read by reader, in write order.
+func (index *sealIndex) lookup(reader store.Reader, name string, fn func(entry containerEntry) error) error {
+	var err error
+	first := sort.Search(int(index.records), func(i int) bool {
+		recordName, _, recordErr := index.record(int64(i))
+		if recordErr != nil {
+			err = recordErr
+			return true
+		}
+		return recordName >= name
+	})
+	if err != nil {
+		return err
+	}
+	prometheus.SealedLookups.Inc()
+	var entries []containerEntry
+	for i := int64(first); i < index.records; i++ {
+		recordName, headerOffset, err := index.record(i)
+		if err != nil {
+			return err
+		}
+		if recordName != name {
+			break
+		}
+		section := io.NewSectionReader(reader, headerOffset, reader.Size()-headerOffset)
+		hdr, err := tar.NewReader(section).Next()
+		if err != nil || hdr.Name != name {
+			// The segment was sealed again after it was opened
+			return errStaleIndex
+		}
+		offset, err := section.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, containerEntry{hdr: hdr, reader: reader, offset: headerOffset + offset})
+	}
+	for _, entry := range entries {
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SealContainer merges the segments of a container whose folder time is over
+// into the container file, with the entries sorted by name, and writes its
+// index. Later writes to the container go to a new segment, sealed again by
+// the next run. The manifest of its hour records the container. It returns nil
+// when the container holds no entries.
+func SealContainer(containerFile string) (*ContainerManifest, error) {
+	if !Sealed(containerFile) {
+		return nil, errors.New("folder time not over: " + containerFile)
+	}
+	var manifest *ContainerManifest
+	err := withLockedContainer(containerFile, func(c *container) error {
+		var entries []containerEntry
+		for _, s := range c.segments {
+			if s.reader == nil {
+				continue
+			}
+			err := scanContainer(s.reader, func(hdr *tar.Header, offset int64) error {
+				if len(hdr.Name) > indexNameSize {
+					return errors.New("name too long for the index: " + hdr.Name)
+				}
+				entries = append(entries, containerEntry{hdr: hdr, reader: s.reader, offset: offset})
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		// Drop the index before the segment changes
+		if err := Containers.Delete(containerFile + SEAL_INDEX); err != nil {
+			return err
+		}
+		defer forgetCommitted(containerFile)
+		defer invalidateBlobsIn(containerFile)
+		if len(entries) == 0 {
+			if err := removeSegments(c); err != nil {
+				return err
+			}
+			return updateManifest(containerFile, func(folder *Manifest) {
+				delete(folder.Containers, containerFile)
+			})
+		}
+		// Entries of the same name keep their write order, tombstones and versions depend on it
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].hdr.Name < entries[j].hdr.Name })
+		err := Containers.Rewrite(containerFile, func(tw *tar.Writer) error {
+			for i := range entries {
+				if err := sealEntry(tw, &entries[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, s := range c.segments {
+			if s.name == containerFile {
+				continue
+			}
+			if err := Containers.Delete(s.name); err != nil {
+				return err
+			}
+			forgetCommitted(s.name)
+		}
+		if manifest, err = indexSegment(containerFile); err != nil {
+			return err
+		}
+		return updateManifest(containerFile, func(folder *Manifest) {
+			folder.Sealed = time.Now()
+			folder.Containers[containerFile] = manifest
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if manifest != nil {
+		prometheus.SealedContainers.Inc()
+	}
+	return manifest, nil
+}
+
+// removeSegments removes the segments of a container without entries, e.g.
+// left empty by a failed append.
+func removeSegments(c *container) error {
+	for _, s := range c.segments {
+		if err := Containers.Delete(s.name); err != nil {
+			return err
+		}
+		forgetCommitted(s.name)
+	}
+	return nil
+}
+
+// sealEntry copies the entry to tw, recompressed with SEAL_COMPRESSION when
+// that makes it smaller. The entry is recompressed twice without buffering it,
+// first to learn the size for the tar header.
+func sealEntry(tw *tar.Writer, entry *containerEntry) error {
+	if config.Settings.Get(config.SEAL_COMPRESSION) != SEAL_ZSTD || entry.hdr.Mode != MODE_GZIP {
+		return copyEntry(tw, entry.reader, entry.hdr, entry.offset)
+	}
+	size, err := recompress(entry, ioutil.Discard)
+	if err != nil {
+		return err
+	}
+	if size >= entry.hdr.Size {
+		return copyEntry(tw, entry.reader, entry.hdr, entry.offset)
+	}
+	hdr := *entry.hdr
+	hdr.Mode = MODE_ZSTD
+	hdr.Size = size
+	if err := tw.WriteHeader(&hdr); err != nil {
+		return err
+	}
+	// The tar writer fails when the size differs from the header
+	_, err = recompress(entry, tw)
+	return err
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// recompress streams the decompressed entry through a zstd encoder to w and
+// returns the compressed size.
+func recompress(entry *containerEntry, w io.Writer) (int64, error) {
+	content, err := entryContent(entry)
+	if err != nil {
+		return 0, err
+	}
+	defer content.Close()
+	encoder := zstdEncoders.Get().(*zstd.Encoder)
+	defer zstdEncoders.Put(encoder)
+	counter := &countingWriter{w: w}
+	encoder.Reset(counter)
+	if _, err := io.Copy(encoder, content); err != nil {
+		encoder.Close()
+		return 0, err
+	}
+	if err := encoder.Close(); err != nil {
+		return 0, err
+	}
+	return counter.n, nil
+}
+
+// indexSegment writes the index of the sorted segment and makes both
+// read-only, later writes go to a new segment. It returns the manifest of the
+// segment.
+func indexSegment(segmentFile string) (*ContainerManifest, error) {
+	manifest, err := writeIndex(segmentFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range []string{segmentFile, segmentFile + SEAL_INDEX} {
+		if err := Containers.ReadOnly(name); err != nil {
+			return nil, err
+		}
+	}
+	return manifest, nil
+}
+
+// writeIndex writes the index of the sorted container and returns its manifest.
+func writeIndex(containerFile string) (*ContainerManifest, error) {
+	reader, err := Containers.Reader(containerFile)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	size := reader.Size()
+	var index bytes.Buffer
+	index.WriteString(indexMagic)
+	binary.Write(&index, binary.BigEndian, uint64(size))
+	container := &ContainerManifest{}
+	headerOffset := int64(0)
+	err = scanContainer(reader, func(hdr *tar.Header, offset int64) error {
+		record := make([]byte, indexRecordSize)
+		copy(record, hdr.Name)
+		binary.BigEndian.PutUint64(record[indexNameSize:], uint64(headerOffset))
+		index.Write(record)
+		container.add(hdr)
+		// The next header follows the content padded to the tar block size
+		headerOffset = offset + (hdr.Size+511)/512*512
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if container.Checksum, err = checksumSegment(reader); err != nil {
+		return nil, err
+	}
+	if err := Containers.Put(containerFile+SEAL_INDEX, bytes.NewReader(index.Bytes()), int64(index.Len())); err != nil {
+		return nil, err
+	}
+	return container, nil
+}
+
+// checksumSegment returns the SHA-256 of the segment read by reader.
+func checksumSegment(reader store.Reader) (string, error) {
+	checksum := sha256.New()
+	if _, err := io.Copy(checksum, io.NewSectionReader(reader, 0, reader.Size())); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(checksum.Sum(nil)), nil
+}
+
+// SealPending seals the containers with segments not sealed yet in the
+// folders whose time is over.
+func SealPending() error {
+	indexed := make(map[string]bool)
+	var segments []string
+	err := Containers.List(CONTAINER_ROOT, func(name string) error {
+		if strings.HasSuffix(name, SEAL_INDEX) {
+			indexed[strings.TrimSuffix(name, SEAL_INDEX)] = true
+		} else if path.Ext(name) == ".tar" {
+			segments = append(segments, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	for _, segment := range segments {
+		containerFile := BaseContainer(segment)
+		if indexed[segment] || seen[containerFile] || !Sealed(containerFile) {
+			continue
+		}
+		seen[containerFile] = true
+		sealed, err := SealContainer(containerFile)
+		if err != nil {
+			fmt.Println("seal failed:", containerFile, err)
+			continue
+		}
+		if sealed != nil {
+			fmt.Printf("Seal: %v %d entries\n", containerFile, sealed.Entries)
+		}
+	}
+	return FlushManifests()
+}
@@ -0,0 +1,150 @@
+package shared
+
+import (
+	"archive/tar"
+	"fmt"
+	"glacier/config"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestSeal(t *testing.T) {
+	memoryContainers(t)
+	t.Cleanup(config.Settings.Override(config.SEAL_SUPPORT, "true"))
+	t.Cleanup(config.Settings.Override(config.SEAL_COMPRESSION, "zstd"))
+	server := testServer(t)
+	get := func(target string) (int, string) {
+		return testRequest(t, "GET", server.URL+"/get/"+target, nil)
+	}
+
+	// Blobs of one container in a sealed hour
+	test_uuid := GenerateTimeUUID()
+	id := func(i int) string {
+		return fmt.Sprintf("20200103-0000-%v%04d%v", test_uuid[14:24], i, test_uuid[28:])
+	}
+	blobs := make(map[string]string)
+	for _, i := range []int{3, 1, 2} {
+		blobs[id(i)] = strings.Repeat(fmt.Sprintf("sealed blob %d ", i), 50)
+		testUpload(t, id(i), "", blobs[id(i)])
+	}
+	testUpload(t, id(1), "thumb", "thumb")
+	if status, body := testRequest(t, "DELETE", server.URL+"/get/"+id(2), nil); status != http.StatusNoContent {
+		t.Fatalf("Wrong delete response-code! Have:%v \"%v\"", status, body)
+	}
+	delete(blobs, id(2))
+
+	if err := SealPending(); err != nil {
+		t.Fatalf("Seal failed! Error:%v", err)
+	}
+	containerFile, _, _ := GetContainerFile(id(1))
+	if _, err := Containers.Size(containerFile + SEAL_INDEX); err != nil {
+		t.Fatalf("Container not indexed! Error:%v", err)
+	}
+	manifest, err := LoadManifest(path.Dir(containerFile))
+	if err != nil || manifest.Containers[containerFile] == nil || manifest.Containers[containerFile].Entries != 4 || manifest.Containers[containerFile].Checksum == "" {
+		t.Fatalf("Wrong manifest! Have:%v Error:%v", manifest, err)
+	}
+	for id, data := range blobs {
+		if status, body := get(id); body != data {
+			t.Fatalf("Wrong sealed content! Have:%v \"%v\"", status, body)
+		}
+	}
+	if status, body := get(id(1) + "?variant=thumb"); body != "thumb" {
+		t.Fatalf("Wrong sealed variant! Have:%v \"%v\"", status, body)
+	}
+	if status, _ := get(id(2)); status != http.StatusNotFound {
+		t.Fatalf("Deleted file readable after seal! Have:%v", status)
+	}
+	reader, err := Containers.Reader(containerFile)
+	if err != nil {
+		t.Fatalf("Unable to read sealed container! Error:%v", err)
+	}
+	recompressed := 0
+	tr := tar.NewReader(io.NewSectionReader(reader, 0, reader.Size()))
+	for hdr, err := tr.Next(); err == nil; hdr, err = tr.Next() {
+		if hdr.Mode == MODE_ZSTD {
+			recompressed++
+		}
+	}
+	reader.Close()
+	// The deleted blob stays until the compactor runs, the small variant is not compressed
+	if recompressed != 3 {
+		t.Fatalf("Blobs not recompressed! Have:%d", recompressed)
+	}
+	err = Containers.Append(containerFile, func(tw *tar.Writer) error { return nil })
+	if !os.IsPermission(err) {
+		t.Fatalf("Sealed container not read-only! Error:%v", err)
+	}
+
+	// Late writes go to a new segment, merged by the next seal
+	testUpload(t, id(4), "", "late")
+	lateSegment := strings.TrimSuffix(containerFile, ".tar") + ".1.tar"
+	if _, err := Containers.Size(lateSegment); err != nil {
+		t.Fatalf("Sealed container appended to! Error:%v", err)
+	}
+	if status, body := get(id(4)); body != "late" {
+		t.Fatalf("Wrong late content! Have:%v \"%v\"", status, body)
+	}
+	if err := SealPending(); err != nil {
+		t.Fatalf("Seal failed! Error:%v", err)
+	}
+	if _, err := Containers.Size(lateSegment); !os.IsNotExist(err) {
+		t.Fatalf("Late segment not merged! Error:%v", err)
+	}
+	if status, body := get(id(4)); body != "late" {
+		t.Fatalf("Wrong late content after seal! Have:%v \"%v\"", status, body)
+	}
+}
+
+func TestCompactSealed(t *testing.T) {
+	memoryContainers(t)
+	t.Cleanup(config.Settings.Override(config.SEAL_SUPPORT, "true"))
+	server := testServer(t)
+	test_uuid := "20200104-0000-" + GenerateTimeUUID()[14:]
+	kept_uuid := test_uuid[:24] + "0000" + test_uuid[28:]
+	testUpload(t, test_uuid, "", "deleted after the seal")
+	testUpload(t, kept_uuid, "", "kept")
+	if err := SealPending(); err != nil {
+		t.Fatalf("Seal failed! Error:%v", err)
+	}
+	if status, body := testRequest(t, "DELETE", server.URL+"/get/"+test_uuid, nil); status != http.StatusNoContent {
+		t.Fatalf("Wrong delete response-code! Have:%v \"%v\"", status, body)
+	}
+	// The tombstone went to a new segment, merged by the next seal
+	if err := SealPending(); err != nil {
+		t.Fatalf("Seal failed! Error:%v", err)
+	}
+	containerFile, _, _ := GetContainerFile(test_uuid)
+	if err := CompactContainer(containerFile); err != nil {
+		t.Fatalf("Compaction failed! Error:%v", err)
+	}
+
+	if _, err := Containers.Size(containerFile + SEAL_INDEX); err != nil {
+		t.Fatalf("Compacted container not indexed! Error:%v", err)
+	}
+	err := Containers.Append(containerFile, func(tw *tar.Writer) error { return nil })
+	if !os.IsPermission(err) {
+		t.Fatalf("Compacted container not read-only! Error:%v", err)
+	}
+	manifest, err := LoadManifest(path.Dir(containerFile))
+	if err != nil || manifest.Containers[containerFile] == nil || manifest.Containers[containerFile].Entries != 1 || manifest.Containers[containerFile].Checksum == "" {
+		t.Fatalf("Wrong manifest! Have:%v Error:%v", manifest, err)
+	}
+	if status, body := testRequest(t, "GET", server.URL+"/get/"+kept_uuid, nil); body != "kept" {
+		t.Fatalf("Kept blob lost by compaction! Have:%v \"%v\"", status, body)
+	}
+	if status, _ := testRequest(t, "GET", server.URL+"/get/"+test_uuid, nil); status != http.StatusNotFound {
+		t.Fatalf("Deleted blob readable after compaction! Have:%v", status)
+	}
+
+	// Late writes still go to a new segment
+	testUpload(t, test_uuid[:24]+"1111"+test_uuid[28:], "", "late")
+	lateSegment := strings.TrimSuffix(containerFile, ".tar") + ".1.tar"
+	if _, err := Containers.Size(lateSegment); err != nil {
+		t.Fatalf("Compacted container appended to! Error:%v", err)
+	}
+}
@@ -4,27 +4,29 @@ import (
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
-	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"glacier/config"
 	"glacier/prometheus"
 	"io"
+	"io/ioutil"
 	"net/http"
-	"os"
 	"path/filepath"
 	"regexp"
 	"strconv"
+	"sync"
 	"time"
+	_ "time/tzdata" // Timezones for LAYOUT_TIMEZONE in the scratch image
 
 	"github.com/gabriel-vasile/mimetype"
-	"github.com/gofrs/flock"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 )
 
-var ctx = context.Background()
-
 func ExtractGUID() *regexp.Regexp {
 	r, err := regexp.Compile("([a-f0-9]{8}-[a-f0-9]{4}-[a-f0-9]{4}-[a-f0-9]{4}-[a-f0-9]{12})")
 	if err != nil {
@@ -35,75 +37,168 @@ func ExtractGUID() *regexp.Regexp {
 
 var extractGUID = ExtractGUID()
 
-func GetContainerFile(uuidString string) (string, string, error) {
-	timeUuid := extractGUID.FindString(uuidString)
-	id, err := uuid.Parse(timeUuid)
-
+func ExtractDateFromFolder() *regexp.Regexp {
+	r, err := regexp.Compile("([0-9]{4}/[0-9]{2}/[0-9]{2}/[0-9]{2})(/[0-9]{2})?/")
 	if err != nil {
-		return "", timeUuid, err
+		panic(err)
 	}
-	if id.Version() == 1 {
-		sec, nsec := id.Time().UnixTime()
-		timestamp := time.Unix(sec, nsec).UTC()
+	return r
+}
 
-		idString := timestamp.Format("200601021504")
-		return "files/" + idString[0:4] + "/" + idString[4:6] + "/" + idString[6:8] + "/" + idString[8:10] + "/" + timeUuid[4:6] + ".tar", timeUuid, err
+var extractDateFromFolder = ExtractDateFromFolder()
+
+// Folder holding the YYYY/MM/DD/HH container tree
+const CONTAINER_ROOT = "files"
+
+var layoutLocation struct {
+	sync.Mutex
+	name     string
+	location *time.Location
+}
+
+// LayoutLocation returns the LAYOUT_TIMEZONE used for v4 time-UUIDs and folder names.
+func LayoutLocation() *time.Location {
+	layoutLocation.Lock()
+	defer layoutLocation.Unlock()
+	name := config.Settings.Get(config.LAYOUT_TIMEZONE)
+	if layoutLocation.location == nil || layoutLocation.name != name {
+		location, err := time.LoadLocation(name)
+		if err != nil {
+			fmt.Println("LAYOUT_TIMEZONE not accepted, using UTC:", err)
+			location = time.UTC
+		}
+		layoutLocation.name = name
+		layoutLocation.location = location
 	}
+	return layoutLocation.location
+}
 
-	if id.Version() != 4 {
-		return "", timeUuid, errors.New("UUID not version 4")
+// GetUUIDTime returns the timestamp embedded in a time-UUID: the RFC 4122
+// timestamp of v1, the millisecond Unix time of v7 and the YYYYMMDD-HHMM of v4
+// time-UUIDs in LAYOUT_TIMEZONE. Extended life v4 time-UUIDs store the keep months in the minute
+// field and only carry the hour.
+func GetUUIDTime(uuidString string) (time.Time, error) {
+	timeUuid := extractGUID.FindString(uuidString)
+	id, err := uuid.Parse(timeUuid)
+	if err != nil {
+		return time.Time{}, err
 	}
-	if timeUuid[0:2] != "20" {
-		return "", timeUuid, errors.New("UUID not time-uuid")
+	switch id.Version() {
+	case 1:
+		sec, nsec := id.Time().UnixTime()
+		return time.Unix(sec, nsec).UTC(), nil
+	case 7:
+		return uuidv7Time(id).UTC(), nil
+	case 4:
+		if timeUuid[0:2] != "20" {
+			return time.Time{}, errors.New("UUID not time-uuid")
+		}
+		if !isExtendedLife(timeUuid) {
+			timestamp, err := time.ParseInLocation("20060102-1504", timeUuid[0:13], LayoutLocation())
+			if err == nil {
+				return timestamp, nil
+			}
+		}
+		timestamp, err := time.ParseInLocation("20060102-15", timeUuid[0:11], LayoutLocation())
+		if err != nil {
+			return time.Time{}, errors.New("UUID unable to pase timeUuid:" + timeUuid)
+		}
+		return timestamp, nil
 	}
+	return time.Time{}, errors.New("UUID not version 4")
+}
 
+// isExtendedLife reports if the minute field of a v4 time-UUID holds keep months
+func isExtendedLife(timeUuid string) bool {
 	keep, err := strconv.ParseUint(timeUuid[11:13], 16, 64)
 	if err != nil {
 		keep = 0
 		fmt.Println("strconv.ParseUint:", err)
 	}
-	//fmt.Println("uint8:", uint8(keep))
-	if config.Settings.Get(config.EXTEND_LIFE_SUPPORT) == "true" && uint8(keep)&0x80 == 0x80 {
-		keep = uint64(uint8(keep) & 0x7f)
-		TimeLayout := "20060102"
-		timestamp, err := time.Parse(TimeLayout, timeUuid[0:8])
-		if err != nil {
-			return "", timeUuid, errors.New("UUID unable to pase timeUuid:" + timeUuid)
-		}
-		//fmt.Println(timestamp)
-		timestamp = timestamp.AddDate(0, int(keep), 0)
-		idString := timestamp.Format("20060102")
-		//fmt.Println(timestamp)
-		return "files/" + idString[0:4] + "/" + idString[4:6] + "/" + idString[6:8] + "/" + timeUuid[9:11] + "/" + timeUuid[34:36] + ".tar", timeUuid, err
-	} else {
-		return "files/" + timeUuid[0:4] + "/" + timeUuid[4:6] + "/" + timeUuid[6:8] + "/" + timeUuid[9:11] + "/" + timeUuid[34:36] + ".tar", timeUuid, err
-	}
+	return config.Settings.Get(config.EXTEND_LIFE_SUPPORT) == "true" && uint8(keep)&0x80 == 0x80
+}
 
+// GetContainerTime returns the start of the folder a container is stored in.
+func GetContainerTime(containerFile string) (time.Time, error) {
+	folder := extractDateFromFolder.FindStringSubmatch(filepath.ToSlash(containerFile))
+	if folder == nil {
+		return time.Time{}, errors.New("no YYYY/MM/DD/HH folder in " + containerFile)
+	}
+	timestamp, err := time.ParseInLocation("2006/01/02/15", folder[1], LayoutLocation())
+	if err != nil || folder[2] == "" {
+		return timestamp, err
+	}
+	minutes, err := strconv.Atoi(folder[2][1:])
+	return timestamp.Add(time.Duration(minutes) * time.Minute), err
 }
 
-func GetFileTime(uuidString string) time.Time {
+func GetContainerFile(uuidString string) (string, string, error) {
 	timeUuid := extractGUID.FindString(uuidString)
-	id, err := uuid.Parse(timeUuid)
-
+	timestamp, err := GetUUIDTime(timeUuid)
 	if err != nil {
-		return time.Now()
+		return "", timeUuid, err
 	}
-
-	if id.Version() != 4 {
-		return time.Now()
+	layout := layoutAt(timestamp)
+	// v1 uses the low time bits before Mid-time[6] as the random part of the UUID, v4 and v7 the last hex-values
+	digits := layout.shardDigits()
+	shard := timeUuid[36-digits : 36]
+	if timeUuid[14] == '1' {
+		shard = timeUuid[6-digits : 6]
 	}
-	if timeUuid[0:2] != "20" {
-		return time.Now()
+	if timeUuid[14] == '4' && isExtendedLife(timeUuid) {
+		keep, _ := strconv.ParseUint(timeUuid[11:13], 16, 64)
+		timestamp = timestamp.AddDate(0, int(uint8(keep)&0x7f), 0)
 	}
+	return CONTAINER_ROOT + "/" + layout.folder(timestamp.In(LayoutLocation())) + "/" + shard + ".tar", timeUuid, nil
+}
 
-	TimeLayout := "20060102"
-	timestamp, err := time.Parse(TimeLayout, timeUuid[0:8])
+// GetFileTime returns the time embedded in the UUID, or now for identifiers without time
+func GetFileTime(uuidString string) time.Time {
+	timestamp, err := GetUUIDTime(uuidString)
 	if err != nil {
 		return time.Now()
 	}
 	return timestamp
 }
 
+type BlobVersion struct {
+	VersionId     string
+	ContainerFile string
+	Size          int64
+	RealSize      int64
+	MimeType      string
+	Compressed    bool
+	IsLatest      bool
+}
+
+func writeVersions(w http.ResponseWriter, containerFile string, entries []containerEntry) {
+	if len(entries) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintln(w, "File not found")
+		return
+	}
+	versions := make([]BlobVersion, 0, len(entries))
+	for i, entry := range entries {
+		versions = append(versions, BlobVersion{
+			VersionId:     entry.hdr.PAXRecords[PAX_VERSION_ID],
+			ContainerFile: containerFile,
+			Size:          entry.hdr.Size,
+			RealSize:      entry.realSize(),
+			MimeType:      entry.hdr.Gname,
+			Compressed:    entry.hdr.Mode != 0,
+			IsLatest:      i == len(entries)-1,
+		})
+	}
+	jData, err := json.Marshal(versions)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jData)
+}
+
 func GetFile(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 	vars := mux.Vars(r)
@@ -130,96 +225,162 @@ func GetFile(w http.ResponseWriter, r *http.Request) {
 		fmt.Println(err)
 		return
 	}
-	fileLock := flock.New(containerFile)
-	locked, err := fileLock.TryLockContext(ctx, 500*time.Millisecond)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintln(w, err)
-		fmt.Println("lock timeout:", err)
+	variant := r.URL.Query().Get("variant")
+	if !ValidVariant(variant) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, ErrVariantName)
 		return
 	}
-	if !locked {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Println("file not locked:")
-		return
+	_, listVersions := r.URL.Query()["versions"]
+	cached := !listVersions && r.URL.Query().Get("versionId") == "" && blobCacheSize() > 0
+	if cached {
+		if blob, ok := getCachedBlob(id, variant); ok {
+			writeBlobHeaders(w, blob.mimeType, blob.versionId)
+			w.Write(blob.data)
+			return
+		}
+		defer endBlobRead(id)
 	}
-	defer fileLock.Unlock()
-	tarFile, err := os.Open(containerFile)
+	c, err := openContainer(containerFile)
 	if err != nil {
+		if !listVersions && fetchFromPeer(w, r, id, variant) {
+			return
+		}
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintln(w, "open tar file failed", err)
 		return
 	}
-	defer tarFile.Close()
+	defer c.Close()
 
-	tr := tar.NewReader(tarFile)
-	for {
-		hdr, err := tr.Next()
-		if err == io.EOF {
-			w.WriteHeader(http.StatusNotFound)
-			fmt.Fprintln(w, "File not found")
-			return
-		}
+	if listVersions {
+		entries, err := visibleEntries(c, id, variant)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			fmt.Fprintln(w, "open tar file failed", err)
 			return
 		}
-		if id == hdr.Name {
-			if len(hdr.Gname) > 0 {
-				w.Header().Set("Content-Type", hdr.Gname)
-			}
-			if hdr.Mode == int64(1) {
-				gzf, err := gzip.NewReader(tr)
-				if err != nil {
-					w.WriteHeader(http.StatusInternalServerError)
-					fmt.Fprintln(w, "gzip decompress error:", err)
-					return
-				}
-				defer gzf.Close()
-				_, err = io.Copy(w, gzf)
-				if err != nil {
-					w.WriteHeader(http.StatusInternalServerError)
-					fmt.Fprintln(w, "open compressed tar file failed", err)
-					fmt.Println("open compressed file failed", err)
-					return
-				}
-			} else {
-				if _, err := io.Copy(w, tr); err != nil {
-					w.WriteHeader(http.StatusInternalServerError)
-					fmt.Fprintln(w, "open tar file failed", err)
-					return
-				}
-			}
+		writeVersions(w, containerFile, entries)
+		return
+	}
+	entry, err := findEntry(c, id, variant, r.URL.Query().Get("versionId"))
+	if err == ErrNotFound && len(fallbackPeers()) > 0 && !deletedIn(c, id) && fetchFromPeer(w, r, id, variant) {
+		return
+	}
+	if err == ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintln(w, "File not found")
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "open tar file failed", err)
+		return
+	}
+	hdr := entry.hdr
+	content, err := entryContent(entry)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "gzip decompress error:", err)
+		return
+	}
+	defer content.Close()
+	if cached && blobCacheable(entry.realSize()) {
+		data, err := ioutil.ReadAll(content)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintln(w, "gzip decompress error:", err)
 			return
 		}
+		blob := &cachedBlob{id: id, variant: variant, containerFile: containerFile, mimeType: hdr.Gname, versionId: hdr.PAXRecords[PAX_VERSION_ID], data: data}
+		putCachedBlob(blob)
+		writeBlobHeaders(w, blob.mimeType, blob.versionId)
+		w.Write(data)
+		return
+	}
+	writeBlobHeaders(w, hdr.Gname, hdr.PAXRecords[PAX_VERSION_ID])
+	if _, err := io.Copy(w, content); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "open tar file failed", err)
+		fmt.Println("open file failed", err)
+		return
 	}
 }
 
-func SharedUpload(r *http.Request, token string, id string, fileBytes []byte) (string, string, error) {
+func writeBlobHeaders(w http.ResponseWriter, mimeType string, versionId string) {
+	if len(mimeType) > 0 {
+		w.Header().Set("Content-Type", mimeType)
+	}
+	if versionId != "" {
+		w.Header().Set("x-amz-version-id", versionId)
+	}
+}
 
-	if config.Settings.Has(config.WRITE_TOKEN) && token != config.Settings.Get(config.WRITE_TOKEN) {
+type UploadResult struct {
+	UUID          string
+	ContainerFile string `json:",omitempty"`
+	Size          int64
+	StoredSize    int64  `json:",omitempty"`
+	MimeType      string `json:",omitempty"`
+	Checksum      string `json:",omitempty"` // SHA-256 of the uploaded content
+	Status        int
+	Error         string `json:",omitempty"`
+}
 
-		return "", "", fmt.Errorf("Access denied")
-	}
+// UploadStatus maps an upload error to its HTTP status code.
+func UploadStatus(err error) int {
+	switch err {
+	case nil:
+		return http.StatusOK
+	case ErrAccessDenied:
+		return http.StatusForbidden
+	case ErrDuplicate:
+		return http.StatusConflict
+	case ErrNotFound, ErrNoOriginal:
+		return http.StatusNotFound
+	case ErrEmptyFile, ErrVariantName:
+		return http.StatusBadRequest
+	}
+	if _, isUUIDError := err.(invalidUUIDError); isUUIDError {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
 
-	containerFile, uuid_id, err := GetContainerFile(id)
+func SharedUpload(r *http.Request, token string, id string, fileBytes []byte) (UploadResult, error) {
+	result, err := uploadVariant(token, id, r.URL.Query().Get("variant"), fileBytes, !Replicated(r))
+	result.Status = UploadStatus(err)
 	if err != nil {
-		fmt.Println(err)
-		return "", "", err
+		result.Error = err.Error()
 	}
-	containerPath := filepath.Dir(containerFile)
+	return result, err
+}
+
+// UploadVariant stores fileBytes as the named variant of id. The original blob
+// is the empty variant and must exist before other variants can be attached.
+func UploadVariant(token string, id string, variant string, fileBytes []byte) (UploadResult, error) {
+	return uploadVariant(token, id, variant, fileBytes, true)
+}
 
-	err = os.MkdirAll(containerPath, 0700)
+// uploadVariant stores the variant, and notifies the commit when replicate is
+// set. Writes received from peers or fetched from them are not replicated.
+func uploadVariant(token string, id string, variant string, fileBytes []byte, replicate bool) (UploadResult, error) {
+	result := UploadResult{UUID: id, Size: int64(len(fileBytes))}
+	if config.Settings.Has(config.WRITE_TOKEN) && token != config.Settings.Get(config.WRITE_TOKEN) {
 
+		return result, ErrAccessDenied
+	}
+	if !ValidVariant(variant) {
+		return result, ErrVariantName
+	}
+
+	containerFile, uuid_id, err := GetContainerFile(id)
 	if err != nil {
 		fmt.Println(err)
-		return "", "", err
+		return result, invalidUUIDError{err}
 	}
-
 	if len(fileBytes) == 0 {
 		fmt.Println("FileSize==0")
-		return "", "", err
+		return result, ErrEmptyFile
 	}
 	mtype := mimetype.Detect(fileBytes)
 	doCompress := false
@@ -239,96 +400,146 @@ func SharedUpload(r *http.Request, token string, id string, fileBytes []byte) (s
 
 		_, err = gw.Write(fileBytes)
 		if err != nil {
-			return "", "", err
+			return result, err
 		}
 		if err := gw.Close(); err != nil {
-			return "", "", err
+			return result, err
 		}
 	}
 
-	fileLock := flock.New(containerFile)
-	locked, err := fileLock.TryLockContext(ctx, 500*time.Millisecond)
-	if err != nil {
-		fmt.Println("lock timeout:", err)
-		return "", "", err
-	}
-	if !locked {
-		fmt.Println("file not locked:")
-		return "", "", err
-	}
-	defer fileLock.Unlock()
-
-	prometheus.Tar_files_open.Inc()
-	defer prometheus.Tar_files_open.Dec()
-
-	f, err := os.OpenFile(containerFile, os.O_RDWR|os.O_CREATE, os.ModePerm)
-	if err != nil {
-		return "", "", err
-	}
-	defer f.Close()
-	fi, err := f.Stat()
-	if err != nil {
-		return "", "", err
-	}
-	if fi.Size() > 0 {
-		if _, err = f.Seek(-2<<9, os.SEEK_END); err != nil {
-			fmt.Println(err)
-		}
-	}
-
-	tw := tar.NewWriter(f)
-
 	metadata := make(map[string]string)
 
 	//metadata["test"] = "test"
-	if !doCompress {
-		hdr := &tar.Header{
-			Name:       uuid_id,
-			Size:       int64(len(fileBytes)),
-			Format:     tar.FormatPAX,
-			Uname:      id,
-			PAXRecords: metadata,
-			Gname:      mtype.String(),
-		}
-
-		if err := tw.WriteHeader(hdr); err != nil {
-			return "", "", err
+	if variant != "" {
+		metadata[PAX_VARIANT] = variant
+	}
+	policy := config.Settings.Get(config.DUPLICATE_POLICY)
+	if policy == DUPLICATE_VERSION {
+		metadata[PAX_VERSION_ID] = strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	hdr := &tar.Header{
+		Name:       uuid_id,
+		Size:       int64(len(fileBytes)),
+		Format:     tar.FormatPAX,
+		Uname:      id,
+		PAXRecords: metadata,
+		Gname:      mtype.String(),
+	}
+	var content io.Reader = bytes.NewReader(fileBytes)
+	if doCompress {
+		hdr.Size = int64(output.Len())
+		hdr.Uid = int(len(fileBytes))
+		hdr.Mode = MODE_GZIP
+		content = &output
+	}
+
+	err = queueWrite(containerFile, func(c *container) error {
+		if variant != "" {
+			_, err := findEntry(c, uuid_id, "", "")
+			if err == ErrNotFound {
+				return ErrNoOriginal
+			}
+			if err != nil {
+				return err
+			}
 		}
-
-		if _, err := tw.Write(fileBytes); err != nil {
-			return "", "", err
+		if policy == DUPLICATE_REJECT {
+			_, err := findEntry(c, uuid_id, variant, "")
+			if err == nil {
+				return ErrDuplicate
+			}
+			if err != ErrNotFound {
+				return err
+			}
 		}
-	} else {
-		hdr := &tar.Header{
-			Name:       uuid_id,
-			Size:       int64(output.Len()),
-			Uid:        int(len(fileBytes)),
-			Format:     tar.FormatPAX,
-			Uname:      id,
-			Gname:      mtype.String(),
-			PAXRecords: metadata,
-			Mode:       1, //Define we use compression
+		err := c.appendEntries(func(tw *tar.Writer) error {
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			_, err := io.Copy(tw, content)
+			return err
+		})
+		if err != nil {
+			return err
 		}
+		return recordUpload(containerFile, hdr)
+	})
+	if err != nil {
+		return result, err
+	}
+	invalidateBlob(uuid_id)
+	if replicate {
+		notifyCommit(Commit{Op: COMMIT_PUT, UUID: uuid_id, Variant: variant, VersionId: metadata[PAX_VERSION_ID]})
+	}
+	prometheus.RawUploadDoneProcessed.Inc()
+	checksum := sha256.Sum256(fileBytes)
+	result = UploadResult{
+		UUID:          uuid_id,
+		ContainerFile: containerFile,
+		Size:          int64(len(fileBytes)),
+		StoredSize:    hdr.Size,
+		MimeType:      mtype.String(),
+		Checksum:      hex.EncodeToString(checksum[:]),
+	}
+	if variant == "" && config.Settings.Get(config.THUMBNAIL_SUPPORT) == "true" && THUMBNAIL_MIME_TYPES[mtype.String()] {
+		queueThumbnail(token, id, fileBytes, replicate)
+	}
+	//	fmt.Fprintf(w, "<html><a href=get/%v>%v</a> <br><a href=%v>%v</a>", id, id, containerFile, containerFile)
+	return result, nil
+}
 
-		if err := tw.WriteHeader(hdr); err != nil {
-			return "", "", err
+// GenerateUUID returns a new identifier of the given UUID version, v1, v4
+// (time-UUID) or v7. Empty version uses the configured default.
+func GenerateUUID(version string) (string, error) {
+	if version == "" {
+		version = config.Settings.Get(config.GENERATED_UUID_VERSION)
+	}
+	switch version {
+	case "v1", "1":
+		id, err := uuid.NewUUID()
+		if err != nil {
+			return "", err
 		}
-		if _, err := io.Copy(tw, &output); err != nil {
-			return "", "", err
+		return id.String(), nil
+	case "v4", "4":
+		return GenerateTimeUUID(), nil
+	case "v7", "7":
+		id, err := NewUUIDv7()
+		if err != nil {
+			return "", err
 		}
+		return id.String(), nil
 	}
+	return "", invalidUUIDError{fmt.Errorf("UUID version %v not supported", version)}
+}
 
-	if err := tw.Close(); err != nil {
-		return "", "", err
+// NewUUIDv7 returns a RFC 9562 UUIDv7 with the current Unix time in milliseconds
+// in the first 48 bits followed by random bits.
+func NewUUIDv7() (uuid.UUID, error) {
+	var id uuid.UUID
+	if _, err := rand.Read(id[:]); err != nil {
+		return id, err
 	}
-	prometheus.RawUploadDoneProcessed.Inc()
-	//	fmt.Fprintf(w, "<html><a href=get/%v>%v</a> <br><a href=%v>%v</a>", id, id, containerFile, containerFile)
-	return id, containerFile, nil
+	ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	for i := 0; i < 6; i++ {
+		id[i] = byte(ms >> (40 - 8*i))
+	}
+	id[6] = 0x70 | id[6]&0x0f // version 7
+	id[8] = 0x80 | id[8]&0x3f // RFC 4122 variant
+	return id, nil
+}
+
+func uuidv7Time(id uuid.UUID) time.Time {
+	var ms int64
+	for i := 0; i < 6; i++ {
+		ms = ms<<8 | int64(id[i])
+	}
+	return time.Unix(0, ms*int64(time.Millisecond))
 }
 
 func GenerateTimeUUID() string {
 	id, _ := uuid.NewRandom()
-	timeStamp := time.Now()
+	timeStamp := time.Now().In(LayoutLocation())
 	idString := timeStamp.Format("20060102-1504") + id.String()[13:]
 	return idString
 }
@@ -0,0 +1,168 @@
+package shared
+
+import (
+	"glacier/config"
+	"testing"
+	"time"
+)
+
+func TestGetUUIDTime(t *testing.T) {
+	extendLifeSupport := config.Settings.Get(config.EXTEND_LIFE_SUPPORT)
+	t.Cleanup(func() {
+		config.Settings.Set(config.EXTEND_LIFE_SUPPORT, "Enable extended life support", extendLifeSupport)
+	})
+	config.Settings.Set(config.EXTEND_LIFE_SUPPORT, "Enable extended life support", "true")
+	tests := []struct {
+		uuid      string
+		time      time.Time
+		container string
+	}{
+		// v1, RFC 4122 timestamp
+		{"e40b2400-5ab1-11ed-8000-000000000000", time.Date(2022, 11, 2, 13, 26, 0, 0, time.UTC), "files/2022/11/02/13/24.tar"},
+		// v4 time-UUID
+		{"20221102-1326-4897-aeed-aaaaaaaaaaaa", time.Date(2022, 11, 2, 13, 26, 0, 0, time.UTC), "files/2022/11/02/13/aa.tar"},
+		// v4 time-UUID with extended life of 3 months
+		{"20221102-1383-4897-aeed-aaaaaaaaaaaa", time.Date(2022, 11, 2, 13, 0, 0, 0, time.UTC), "files/2023/02/02/13/aa.tar"},
+		// v7, millisecond Unix time
+		{"01843885-2240-7000-8000-0000000000bb", time.Date(2022, 11, 2, 13, 26, 0, 0, time.UTC), "files/2022/11/02/13/bb.tar"},
+	}
+	for _, test := range tests {
+		timestamp, err := GetUUIDTime(test.uuid)
+		if err != nil {
+			t.Fatalf("GetUUIDTime(%v) error:%v", test.uuid, err)
+		}
+		if !timestamp.Equal(test.time) {
+			t.Errorf("GetUUIDTime(%v) Want:%v Have:%v", test.uuid, test.time, timestamp)
+		}
+		if !GetFileTime(test.uuid).Equal(test.time) {
+			t.Errorf("GetFileTime(%v) Want:%v Have:%v", test.uuid, test.time, GetFileTime(test.uuid))
+		}
+		containerFile, _, err := GetContainerFile(test.uuid)
+		if err != nil || containerFile != test.container {
+			t.Errorf("GetContainerFile(%v) Want:%v Have:%v Error:%v", test.uuid, test.container, containerFile, err)
+		}
+	}
+}
+
+func TestGetUUIDTimeRejectsRandomUUID(t *testing.T) {
+	if _, err := GetUUIDTime("8f4d6a00-5a9a-4a7b-8000-000000000000"); err == nil {
+		t.Fatalf("Random v4 UUID accepted as time-UUID")
+	}
+}
+
+func TestGetContainerTime(t *testing.T) {
+	timestamp, err := GetContainerTime("/files/2022/11/02/13/aa.tar")
+	if err != nil || !timestamp.Equal(time.Date(2022, 11, 2, 13, 0, 0, 0, time.UTC)) {
+		t.Fatalf("GetContainerTime Have:%v Error:%v", timestamp, err)
+	}
+}
+
+func TestLayoutTimezone(t *testing.T) {
+	t.Cleanup(config.Settings.Override(config.LAYOUT_TIMEZONE, "Europe/Copenhagen"))
+
+	// v4 time-UUIDs hold wall clock time of the layout timezone
+	timestamp, _ := GetUUIDTime("20221102-1326-4897-aeed-aaaaaaaaaaaa")
+	if !timestamp.Equal(time.Date(2022, 11, 2, 12, 26, 0, 0, time.UTC)) {
+		t.Errorf("GetUUIDTime Have:%v", timestamp)
+	}
+	containerFile, _, _ := GetContainerFile("20221102-1326-4897-aeed-aaaaaaaaaaaa")
+	if containerFile != "files/2022/11/02/13/aa.tar" {
+		t.Errorf("GetContainerFile v4 Have:%v", containerFile)
+	}
+	// v1 timestamps are UTC and mapped into the folder of the layout timezone
+	containerFile, _, _ = GetContainerFile("e40b2400-5ab1-11ed-8000-000000000000")
+	if containerFile != "files/2022/11/02/14/24.tar" {
+		t.Errorf("GetContainerFile v1 Have:%v", containerFile)
+	}
+	containerTime, _ := GetContainerTime(containerFile)
+	if !containerTime.Equal(time.Date(2022, 11, 2, 13, 0, 0, 0, time.UTC)) {
+		t.Errorf("GetContainerTime Have:%v", containerTime)
+	}
+}
+
+func TestLayoutDescriptor(t *testing.T) {
+	list := layouts.list
+	t.Cleanup(func() { layouts.list = list })
+	t.Cleanup(config.Settings.Override(config.DATA_FOLDER, t.TempDir()))
+	t.Cleanup(config.Settings.Override(config.CONTAINER_SHARDS, "256"))
+	t.Cleanup(config.Settings.Override(config.FOLDER_MINUTES, "60"))
+	if err := LoadLayout(); err != nil {
+		t.Fatalf("LoadLayout error:%v", err)
+	}
+	config.Settings.Override(config.CONTAINER_SHARDS, "4096")
+	config.Settings.Override(config.FOLDER_MINUTES, "10")
+	if err := LoadLayout(); err != nil {
+		t.Fatalf("LoadLayout error:%v", err)
+	}
+	if len(layouts.list) != 2 || layouts.list[1].Shards != 4096 {
+		t.Fatalf("Layout change not recorded! Have:%+v", layouts.list)
+	}
+
+	// Data written before the change keeps the old layout
+	containerFile, _, _ := GetContainerFile("20221102-1326-4897-aeed-aaaaaaaaaaaa")
+	if containerFile != "files/2022/11/02/13/aa.tar" {
+		t.Errorf("GetContainerFile old layout Have:%v", containerFile)
+	}
+	timestamp := layouts.list[1].From.Add(time.Minute)
+	id := timestamp.Format("20060102-1504") + "-4897-aeed-aaaaaaaaabcd"
+	containerFile, _, _ = GetContainerFile(id)
+	want := "files/" + timestamp.Format("2006/01/02/15") + "/" + timestamp.Format("04")[0:1] + "0/" + id[33:36] + ".tar"
+	if containerFile != want {
+		t.Errorf("GetContainerFile new layout Want:%v Have:%v", want, containerFile)
+	}
+	containerTime, err := GetContainerTime(containerFile)
+	if err != nil || !containerTime.Equal(timestamp.Truncate(10*time.Minute)) {
+		t.Errorf("GetContainerTime Have:%v Error:%v", containerTime, err)
+	}
+}
+
+func TestBlobCache(t *testing.T) {
+	t.Cleanup(config.Settings.Override(config.BLOB_CACHE_SIZE, "1"))
+	t.Cleanup(config.Settings.Override(config.BLOB_CACHE_MAX_BLOB, "600"))
+	if blobCacheable(601 << 10) {
+		t.Errorf("Blob above BLOB_CACHE_MAX_BLOB cacheable")
+	}
+
+	for _, id := range []string{"cache-a", "cache-b"} {
+		if _, ok := getCachedBlob(id, ""); ok {
+			t.Fatalf("Blob %v cached before read", id)
+		}
+		putCachedBlob(&cachedBlob{id: id, containerFile: "files/cache.tar", data: make([]byte, 600<<10)})
+		endBlobRead(id)
+	}
+	if _, ok := getCachedBlob("cache-a", ""); ok {
+		t.Errorf("Least recently used blob not evicted")
+	}
+	endBlobRead("cache-a")
+	if _, ok := getCachedBlob("cache-b", ""); !ok {
+		t.Errorf("Blob not cached")
+	}
+
+	// A write during the read keeps the old content out of the cache
+	invalidateBlob("cache-b")
+	getCachedBlob("cache-b", "")
+	invalidateBlob("cache-b")
+	putCachedBlob(&cachedBlob{id: "cache-b", data: []byte("old")})
+	endBlobRead("cache-b")
+	if _, ok := getCachedBlob("cache-b", ""); ok {
+		t.Errorf("Stale blob cached")
+	}
+	endBlobRead("cache-b")
+}
+
+func TestDataFolderLock(t *testing.T) {
+	t.Cleanup(config.Settings.Override(config.DATA_FOLDER, t.TempDir()))
+	unlock, err := LockDataFolder(false)
+	if err != nil {
+		t.Fatalf("Unable to lock data folder! Error:%v", err)
+	}
+	if _, err := LockDataFolder(true); err != ErrDataFolderInUse {
+		t.Fatalf("Command ran next to the server! Error:%v", err)
+	}
+	unlock()
+	unlock, err = LockDataFolder(true)
+	if err != nil {
+		t.Fatalf("Unable to lock stopped data folder! Error:%v", err)
+	}
+	unlock()
+}
@@ -0,0 +1,143 @@
+package shared
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"glacier/config"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"strconv"
+	"sync"
+)
+
+// Variant name used for generated thumbnails
+const THUMBNAIL_VARIANT = "thumb"
+
+var THUMBNAIL_MIME_TYPES = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+}
+
+var ErrImageTooLarge = errors.New("Image exceeds THUMBNAIL_MAX_PIXELS")
+
+type thumbnailRequest struct {
+	token     string
+	id        string
+	fileBytes []byte
+	replicate bool // Peers generate the thumbnails of replicated uploads themselves
+}
+
+// Uploads waiting for their thumbnail, generated one at a time
+var (
+	thumbnailQueue  = make(chan thumbnailRequest, 64)
+	thumbnailWorker sync.Once
+)
+
+// queueThumbnail generates the thumbnail variant of id after the upload
+// returned. Images above THUMBNAIL_MAX_PIXELS are skipped before decoding.
+func queueThumbnail(token string, id string, fileBytes []byte, replicate bool) {
+	if err := checkImageSize(fileBytes); err != nil {
+		fmt.Println("thumbnail skipped:", id, err)
+		return
+	}
+	thumbnailWorker.Do(func() { go generateThumbnails() })
+	select {
+	case thumbnailQueue <- thumbnailRequest{token: token, id: id, fileBytes: fileBytes, replicate: replicate}:
+	default:
+		fmt.Println("thumbnail skipped, queue full:", id)
+	}
+}
+
+func generateThumbnails() {
+	for req := range thumbnailQueue {
+		size, err := strconv.Atoi(config.Settings.Get(config.THUMBNAIL_SIZE))
+		if err != nil || size < 1 {
+			size = 128
+		}
+		thumbnail, err := generateThumbnail(req.fileBytes, size)
+		if err != nil {
+			fmt.Println("thumbnail failed:", req.id, err)
+		} else if _, err := uploadVariant(req.token, req.id, THUMBNAIL_VARIANT, thumbnail, req.replicate); err != nil {
+			fmt.Println("thumbnail upload failed:", req.id, err)
+		}
+	}
+}
+
+// checkImageSize reads the image dimensions from its header, without decoding
+// the pixels.
+func checkImageSize(fileBytes []byte) error {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(fileBytes))
+	if err != nil {
+		return err
+	}
+	max, err := strconv.ParseInt(config.Settings.Get(config.THUMBNAIL_MAX_PIXELS), 10, 64)
+	if err != nil || max < 1 {
+		max = 50000000
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > max {
+		return ErrImageTooLarge
+	}
+	return nil
+}
+
+// generateThumbnail scales the image down to fit within size x size pixels and encodes it as PNG.
+func generateThumbnail(fileBytes []byte, size int) ([]byte, error) {
+	if err := checkImageSize(fileBytes); err != nil {
+		return nil, err
+	}
+	src, _, err := image.Decode(bytes.NewReader(fileBytes))
+	if err != nil {
+		return nil, err
+	}
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > size || height > size {
+		if width > height {
+			height = height * size / width
+			width = size
+		} else {
+			width = width * size / height
+			height = size
+		}
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+
+	// Box filter: every thumbnail pixel is the average of the source pixels it covers
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/height
+		y1 := bounds.Min.Y + (y+1)*bounds.Dy()/height
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/width
+			x1 := bounds.Min.X + (x+1)*bounds.Dx()/width
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			if n == 0 {
+				continue
+			}
+			dst.Set(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(b / n), uint16(a / n)})
+		}
+	}
+
+	var output bytes.Buffer
+	if err := png.Encode(&output, dst); err != nil {
+		return nil, err
+	}
+	return output.Bytes(), nil
+}
@@ -0,0 +1,50 @@
+package shared
+
+import (
+	"bytes"
+	"encoding/binary"
+	"glacier/config"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestThumbnail(t *testing.T) {
+	memoryContainers(t)
+	t.Cleanup(config.Settings.Override(config.THUMBNAIL_SUPPORT, "true"))
+	server := testServer(t)
+	test_uuid := GenerateTimeUUID()
+	var data bytes.Buffer
+	png.Encode(&data, image.NewRGBA(image.Rect(0, 0, 300, 200)))
+	testUpload(t, test_uuid, "", data.String())
+
+	// Thumbnails are generated after the upload returned
+	status, body := http.StatusNotFound, ""
+	for i := 0; i < 50 && status == http.StatusNotFound; i++ {
+		time.Sleep(100 * time.Millisecond)
+		status, body = testRequest(t, "GET", server.URL+"/get/"+test_uuid+"?variant=thumb", nil)
+	}
+	thumbnail, err := png.Decode(bytes.NewReader([]byte(body)))
+	if err != nil {
+		t.Fatalf("Unable to decode thumbnail! Have:%v Error:%v", status, err)
+	}
+	if thumbnail.Bounds().Dx() != 128 || thumbnail.Bounds().Dy() != 85 {
+		t.Fatalf("Wrong thumbnail size! Have:%v", thumbnail.Bounds())
+	}
+}
+
+func TestThumbnailMaxPixels(t *testing.T) {
+	// A small PNG declaring a huge canvas is rejected before its pixels are decoded
+	var data bytes.Buffer
+	png.Encode(&data, image.NewGray(image.Rect(0, 0, 1, 1)))
+	huge := data.Bytes()
+	binary.BigEndian.PutUint32(huge[16:], 100000)
+	binary.BigEndian.PutUint32(huge[20:], 100000)
+	binary.BigEndian.PutUint32(huge[29:], crc32.ChecksumIEEE(huge[12:29]))
+	if _, err := generateThumbnail(huge, 128); err != ErrImageTooLarge {
+		t.Fatalf("Huge image decoded! Error:%v", err)
+	}
+}
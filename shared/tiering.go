@@ -0,0 +1,307 @@
+package shared
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"glacier/config"
+	"glacier/prometheus"
+	"glacier/store"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tierEntry is a tar entry of a tiered segment with the offset of its content in the remote object.
+type tierEntry struct {
+	Name       string
+	Size       int64
+	Mode       int64             `json:",omitempty"`
+	Uid        int               `json:",omitempty"`
+	Uname      string            `json:",omitempty"`
+	Gname      string            `json:",omitempty"`
+	PAXRecords map[string]string `json:",omitempty"`
+	Offset     int64
+}
+
+type tierSegment struct {
+	Object  string
+	Entries []tierEntry
+}
+
+// tierCatalog records where the segments of a tiered container are stored.
+type tierCatalog struct {
+	Backend  string
+	Tiered   time.Time
+	Segments []tierSegment
+}
+
+// remoteObject reads entries of a tiered segment with range requests.
+type remoteObject struct {
+	object string
+}
+
+// TieringEnabled reports if sealed containers are moved to the STORAGE_BACKEND
+// store, instead of being kept in place until autoclean deletes them.
+func TieringEnabled() bool {
+	return store.Backend() != store.BACKEND_LOCAL || config.Settings.Has(config.STORAGE_LOCAL_ROOT)
+}
+
+var tierStore = struct {
+	sync.Mutex
+	store    store.ColdStore
+	settings string
+}{}
+
+// sealedStore returns the store of sealed containers, created again when its settings changed.
+func sealedStore() (store.ColdStore, error) {
+	settings := strings.Join([]string{
+		store.Backend(),
+		config.Settings.Get(config.STORAGE_LOCAL_ROOT),
+		config.Settings.Get(config.TIERING_ENDPOINT),
+		config.Settings.Get(config.TIERING_BUCKET),
+		config.Settings.Get(config.SWIFT_AUTH_URL),
+		config.Settings.Get(config.SWIFT_CONTAINER),
+	}, "\n")
+	tierStore.Lock()
+	defer tierStore.Unlock()
+	if tierStore.store == nil || tierStore.settings != settings {
+		s, err := store.NewCold()
+		if err != nil {
+			return nil, err
+		}
+		tierStore.store = s
+		tierStore.settings = settings
+	}
+	return tierStore.store, nil
+}
+
+// catalogFile returns the catalog of a tiered container, kept in DATA_FOLDER
+// next to the data it replaces.
+func catalogFile(containerFile string) string {
+	return filepath.Join(tieringFolder(), containerFile+".json")
+}
+
+func tieringFolder() string {
+	return filepath.Join(config.Settings.Get(config.DATA_FOLDER), "tiering")
+}
+
+func loadCatalog(containerFile string) (*tierCatalog, error) {
+	data, err := ioutil.ReadFile(catalogFile(containerFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var catalog tierCatalog
+	if err := json.Unmarshal(data, &catalog); err != nil {
+		return nil, err
+	}
+	return &catalog, nil
+}
+
+// tieredBlob reports if the tiered entries of the container hold id, not deleted.
+func tieredBlob(containerFile string, id string) (bool, error) {
+	catalog, err := loadCatalog(containerFile)
+	if err != nil || catalog == nil {
+		return false, err
+	}
+	found := false
+	err = scanCatalog(catalog, func(entry containerEntry) error {
+		if entry.hdr.Name == id {
+			found = !isTombstone(entry.hdr)
+		}
+		return nil
+	})
+	return found, err
+}
+
+// Sealed reports if the folder of the container is over, so no more blobs are written to it.
+func Sealed(containerFile string) bool {
+	return overSince(containerFile, 0)
+}
+
+// overSince reports if the folder of the container is over for longer than age.
+func overSince(containerFile string, age time.Duration) bool {
+	start, err := GetContainerTime(containerFile)
+	if err != nil {
+		return false
+	}
+	duration := time.Duration(layoutAt(start).FolderMinutes) * time.Minute
+	return time.Since(start) > duration+time.Minute+age
+}
+
+// TieringAge returns TIERING_AGE, the time after its folder time a sealed
+// container is tiered. Without it containers are only tiered when autoclean
+// needs space.
+func TieringAge() (time.Duration, bool) {
+	hours, err := strconv.Atoi(config.Settings.Get(config.TIERING_AGE))
+	if err != nil || hours < 0 || !TieringEnabled() {
+		return 0, false
+	}
+	return time.Duration(hours) * time.Hour, true
+}
+
+// TierContainer moves the segments of a sealed container to the STORAGE_BACKEND
+// store, records the stored entries in its catalog and removes the local
+// segments. Blobs of the container are read from the store afterwards.
+func TierContainer(containerFile string) error {
+	segments, err := segmentFiles(containerFile)
+	if err != nil || len(segments) == 0 {
+		return err
+	}
+	if !Sealed(containerFile) {
+		return errors.New("container not sealed: " + containerFile)
+	}
+	sealed, err := sealedStore()
+	if err != nil {
+		return err
+	}
+	return withLockedContainer(containerFile, func(c *container) error {
+		catalog, err := loadCatalog(containerFile)
+		if err != nil {
+			return err
+		}
+		if catalog == nil {
+			catalog = &tierCatalog{Backend: store.Backend()}
+		}
+		// Segments tiered before keep their objects, numbered after them
+		number := len(catalog.Segments)
+		for _, s := range c.segments {
+			if s.reader == nil {
+				continue
+			}
+			segment := tierSegment{Object: segmentName(containerFile, number)}
+			number++
+			err := scanContainer(s.reader, func(hdr *tar.Header, offset int64) error {
+				segment.Entries = append(segment.Entries, tierEntry{
+					Name:       hdr.Name,
+					Size:       hdr.Size,
+					Mode:       hdr.Mode,
+					Uid:        hdr.Uid,
+					Uname:      hdr.Uname,
+					Gname:      hdr.Gname,
+					PAXRecords: hdr.PAXRecords,
+					Offset:     offset,
+				})
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if len(segment.Entries) == 0 {
+				continue
+			}
+			size := s.reader.Size()
+			if err := sealed.Put(segment.Object, io.NewSectionReader(s.reader, 0, size), size); err != nil {
+				return err
+			}
+			catalog.Segments = append(catalog.Segments, segment)
+		}
+		catalog.Tiered = time.Now()
+		if err := saveCatalog(containerFile, catalog); err != nil {
+			return err
+		}
+		for _, s := range c.segments {
+			if err := Containers.Delete(s.name + SEAL_INDEX); err != nil {
+				return err
+			}
+			if err := Containers.Delete(s.name); err != nil {
+				return err
+			}
+			forgetCommitted(s.name)
+		}
+		invalidateBlobsIn(containerFile)
+		prometheus.TieredContainers.Inc()
+		return nil
+	})
+}
+
+// TierPending moves the containers of the folders over for longer than
+// TIERING_AGE to the STORAGE_BACKEND store.
+func TierPending() error {
+	age, ok := TieringAge()
+	if !ok {
+		return nil
+	}
+	var pending []string
+	seen := make(map[string]bool)
+	err := Containers.List(CONTAINER_ROOT, func(name string) error {
+		if path.Ext(name) != ".tar" {
+			return nil
+		}
+		containerFile := BaseContainer(name)
+		if !seen[containerFile] && overSince(containerFile, age) {
+			seen[containerFile] = true
+			pending = append(pending, containerFile)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, containerFile := range pending {
+		if err := TierContainer(containerFile); err != nil {
+			fmt.Println("tiering failed:", containerFile, err)
+			continue
+		}
+		fmt.Printf("Tier: %v\n", containerFile)
+	}
+	return nil
+}
+
+func saveCatalog(containerFile string, catalog *tierCatalog) error {
+	file := catalogFile(containerFile)
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(catalog)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(file+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+// scanCatalog calls fn for every tiered entry in write order.
+func scanCatalog(catalog *tierCatalog, fn func(entry containerEntry) error) error {
+	for _, segment := range catalog.Segments {
+		remote := &remoteObject{object: segment.Object}
+		for _, e := range segment.Entries {
+			hdr := &tar.Header{
+				Name:       e.Name,
+				Size:       e.Size,
+				Mode:       e.Mode,
+				Uid:        e.Uid,
+				Uname:      e.Uname,
+				Gname:      e.Gname,
+				PAXRecords: e.PAXRecords,
+				Format:     tar.FormatPAX,
+			}
+			if err := fn(containerEntry{hdr: hdr, remote: remote, offset: e.Offset}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// openRange returns the bytes from offset of the remote object with one range request.
+func (remote *remoteObject) openRange(offset int64, size int64) (io.ReadCloser, error) {
+	sealed, err := sealedStore()
+	if err != nil {
+		return nil, err
+	}
+	prometheus.TieredReads.Inc()
+	return sealed.Open(remote.object, offset, size)
+}
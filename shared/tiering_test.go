@@ -0,0 +1,130 @@
+package shared
+
+import (
+	"bytes"
+	"glacier/config"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testColdStore serves an S3 endpoint for tiering and counts its range reads.
+func testColdStore(t *testing.T) func() int {
+	var mutex sync.Mutex
+	objects := make(map[string][]byte)
+	buckets := make(map[string]bool)
+	ranges := 0
+	cold := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		parts := strings.SplitN(strings.Trim(r.URL.Path, "/"), "/", 2)
+		switch {
+		case len(parts) == 1 && r.Method == "PUT":
+			buckets[parts[0]] = true
+			return
+		case !buckets[parts[0]]:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case "PUT":
+			objects[r.URL.Path], _ = ioutil.ReadAll(r.Body)
+		case "GET":
+			object, ok := objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if r.Header.Get("Range") != "" {
+				ranges++
+			}
+			http.ServeContent(w, r, "", time.Now(), bytes.NewReader(object))
+		}
+	}))
+	t.Cleanup(cold.Close)
+	t.Cleanup(config.Settings.Override(config.TIERING_ENDPOINT, cold.Listener.Addr().String()))
+	t.Cleanup(config.Settings.Override(config.TIERING_SSL, "false"))
+	return func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return ranges
+	}
+}
+
+func TestTiering(t *testing.T) {
+	memoryContainers(t)
+	ranges := testColdStore(t)
+	server := testServer(t)
+
+	// Blobs of a sealed hour, one stored compressed
+	test_uuid := GenerateTimeUUID()
+	blobs := map[string]string{
+		"20200101-0000-" + test_uuid[14:]:                             strings.Repeat("tiered and compressed ", 20),
+		"20200101-0000-" + test_uuid[14:24] + "0000" + test_uuid[28:]: "tiered",
+	}
+	for id, data := range blobs {
+		testUpload(t, id, "", data)
+	}
+	containerFile, _, _ := GetContainerFile("20200101-0000-" + test_uuid[14:])
+	if err := TierContainer(containerFile); err != nil {
+		t.Fatalf("Tiering failed! Error:%v", err)
+	}
+	if _, err := Containers.Size(containerFile); !os.IsNotExist(err) {
+		t.Fatalf("Tiered container still stored! Error:%v", err)
+	}
+
+	for id, data := range blobs {
+		if status, body := testRequest(t, "GET", server.URL+"/get/"+id, nil); body != data {
+			t.Fatalf("Wrong tiered content! Have:%v \"%v\"", status, body)
+		}
+	}
+	if ranges() != len(blobs) {
+		t.Fatalf("Tiered blobs not read by range! Have:%v", ranges())
+	}
+
+	// A tombstone would leave the tiered copy readable
+	if status, _ := testRequest(t, "DELETE", server.URL+"/get/20200101-0000-"+test_uuid[14:], nil); status != http.StatusConflict {
+		t.Fatalf("Tiered blob delete not refused! Have:%v", status)
+	}
+}
+
+func TestTieringAge(t *testing.T) {
+	memoryContainers(t)
+	testColdStore(t)
+	test_uuid := GenerateTimeUUID()
+	oldId := "20200102-0000-" + test_uuid[14:]
+	recentId := time.Now().In(LayoutLocation()).Add(-2*time.Hour).Format("20060102-1504") + test_uuid[13:]
+	for _, id := range []string{oldId, recentId} {
+		testUpload(t, id, "", "pending "+id)
+	}
+	oldFile, _, _ := GetContainerFile(oldId)
+	recentFile, _, _ := GetContainerFile(recentId)
+
+	// Without TIERING_AGE only autoclean tiers containers
+	if err := TierPending(); err != nil {
+		t.Fatalf("Tiering failed! Error:%v", err)
+	}
+	if _, err := Containers.Size(oldFile); err != nil {
+		t.Fatalf("Container tiered without TIERING_AGE! Error:%v", err)
+	}
+
+	t.Cleanup(config.Settings.Override(config.TIERING_AGE, "24"))
+	if err := TierPending(); err != nil {
+		t.Fatalf("Tiering failed! Error:%v", err)
+	}
+	if _, err := Containers.Size(oldFile); !os.IsNotExist(err) {
+		t.Fatalf("Old container not tiered! Error:%v", err)
+	}
+	if _, err := Containers.Size(recentFile); err != nil {
+		t.Fatalf("Container tiered before TIERING_AGE! Error:%v", err)
+	}
+	data, _, err := ReadBlob(oldId, "", "")
+	if err != nil || string(data) != "pending "+oldId {
+		t.Fatalf("Wrong tiered content! Have:\"%v\" Error:%v", string(data), err)
+	}
+}
@@ -0,0 +1,49 @@
+package shared
+
+import (
+	"encoding/json"
+	"glacier/config"
+	"testing"
+)
+
+func TestVersions(t *testing.T) {
+	memoryContainers(t)
+	t.Cleanup(config.Settings.Override(config.DUPLICATE_POLICY, "version"))
+	server := testServer(t)
+	test_uuid := GenerateTimeUUID()
+	for _, data := range []string{"first version", "second version"} {
+		testUpload(t, test_uuid, "", data)
+	}
+
+	if status, body := testRequest(t, "GET", server.URL+"/get/"+test_uuid, nil); body != "second version" {
+		t.Fatalf("Latest version not returned! Have:%v \"%v\"", status, body)
+	}
+	_, body := testRequest(t, "GET", server.URL+"/get/"+test_uuid+"?versions", nil)
+	var versions []BlobVersion
+	if err := json.Unmarshal([]byte(body), &versions); err != nil || len(versions) != 2 {
+		t.Fatalf("Wrong version list! Have:%v Error:%v", versions, err)
+	}
+	if status, body := testRequest(t, "GET", server.URL+"/get/"+test_uuid+"?versionId="+versions[0].VersionId, nil); body != "first version" {
+		t.Fatalf("First version not returned! Have:%v \"%v\"", status, body)
+	}
+}
+
+func TestVariant(t *testing.T) {
+	memoryContainers(t)
+	server := testServer(t)
+	test_uuid := GenerateTimeUUID()
+	if _, err := UploadVariant("", test_uuid, "thumb", []byte("thumb")); err != ErrNoOriginal {
+		t.Fatalf("Variant accepted without original! Error:%v", err)
+	}
+	testUpload(t, test_uuid, "", "data")
+	testUpload(t, test_uuid, "thumb", "data?variant=thumb")
+	if _, err := UploadVariant("", test_uuid, "<b>x</b>", []byte("markup")); err != ErrVariantName {
+		t.Fatalf("Invalid variant name accepted! Error:%v", err)
+	}
+
+	for _, get := range []string{"", "?variant=thumb"} {
+		if status, body := testRequest(t, "GET", server.URL+"/get/"+test_uuid+get, nil); body != "data"+get {
+			t.Fatalf("Wrong variant returned! Want:\"%v\" Have:%v \"%v\"", "data"+get, status, body)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package shared
+
+import (
+	"fmt"
+	"glacier/config"
+	"glacier/prometheus"
+	"glacier/store"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Time a container writer waits for new writes before it stops
+const WRITER_IDLE = 10 * time.Second
+
+type writeRequest struct {
+	fn   func(c *container) error
+	done chan error
+}
+
+// containerWriter appends the queued writes of one container in batches,
+// holding the container lock once per batch.
+type containerWriter struct {
+	containerFile string
+	queue         chan *writeRequest
+	pending       int // Writes handed out but not yet received, guarded by writers
+}
+
+// Length of the segments written by the container writers up to the last
+// committed batch. Readers scan segments missing here up to their size.
+var committed = struct {
+	sync.Mutex
+	m map[string]int64
+}{m: make(map[string]int64)}
+
+// beginAppend records the committed length of the segment before the writer appends to it.
+func beginAppend(segmentFile string) error {
+	committed.Lock()
+	defer committed.Unlock()
+	if _, ok := committed.m[segmentFile]; ok {
+		return nil
+	}
+	size, err := segmentSize(segmentFile)
+	if err != nil {
+		return err
+	}
+	committed.m[segmentFile] = size
+	return nil
+}
+
+// commitLengths records the length of the written segments after a batch is on disk.
+func commitLengths(c *container) error {
+	committed.Lock()
+	defer committed.Unlock()
+	for name := range c.written {
+		size, err := Containers.Size(name)
+		if err != nil {
+			return err
+		}
+		committed.m[name] = size
+	}
+	return nil
+}
+
+func forgetCommitted(segmentFile string) {
+	committed.Lock()
+	delete(committed.m, segmentFile)
+	committed.Unlock()
+}
+
+// committedEntries returns the length of the committed entries of the segment
+// read by reader, without the end-of-archive marker the next append overwrites.
+func committedEntries(segmentFile string, reader store.Reader) int64 {
+	// Size before the lookup, a writer records the length before appending
+	length := reader.Size()
+	committed.Lock()
+	if size, ok := committed.m[segmentFile]; ok && size < length {
+		length = size
+	}
+	committed.Unlock()
+	if length < 2<<9 {
+		return 0
+	}
+	return length - 2<<9
+}
+
+var writers = struct {
+	sync.Mutex
+	m map[string]*containerWriter
+}{m: make(map[string]*containerWriter)}
+
+func writeQueueSize() int {
+	size, err := strconv.Atoi(config.Settings.Get(config.WRITE_QUEUE_SIZE))
+	if err != nil || size < 1 {
+		return 64
+	}
+	return size
+}
+
+// queueWrite hands fn to the writer of the container and waits until the batch
+// holding it is committed. fn runs with the container locked and open, and
+// must only append. Callers wait while the queue is full.
+func queueWrite(containerFile string, fn func(c *container) error) error {
+	writers.Lock()
+	w, ok := writers.m[containerFile]
+	if !ok {
+		w = &containerWriter{containerFile: containerFile, queue: make(chan *writeRequest, writeQueueSize())}
+		writers.m[containerFile] = w
+		go w.run()
+	}
+	w.pending++
+	writers.Unlock()
+
+	req := &writeRequest{fn: fn, done: make(chan error, 1)}
+	prometheus.WriteQueueDepth.Inc()
+	w.queue <- req
+	return <-req.done
+}
+
+func (w *containerWriter) run() {
+	for {
+		select {
+		case req := <-w.queue:
+			batch := []*writeRequest{req}
+			for more := true; more && len(batch) < cap(w.queue); {
+				select {
+				case req := <-w.queue:
+					batch = append(batch, req)
+				default:
+					more = false
+				}
+			}
+			writers.Lock()
+			w.pending -= len(batch)
+			writers.Unlock()
+			prometheus.WriteQueueDepth.Sub(float64(len(batch)))
+			w.commit(batch)
+		case <-time.After(WRITER_IDLE):
+			writers.Lock()
+			if w.pending == 0 {
+				// Without a writer the segments are committed up to their size
+				if segments, err := segmentFiles(w.containerFile); err == nil {
+					for _, segment := range segments {
+						forgetCommitted(segment)
+					}
+				}
+				delete(writers.m, w.containerFile)
+				writers.Unlock()
+				return
+			}
+			writers.Unlock()
+		}
+	}
+}
+
+// commit runs the batch under one container lock and fsync, and reports the
+// result to every caller once the batch is on disk.
+func (w *containerWriter) commit(batch []*writeRequest) {
+	results := make([]error, len(batch))
+	// Wait for the lock instead of failing the writes, readers and the compactor release it
+	unlock, err := Containers.Lock(w.containerFile)
+	if err == nil {
+		err = withOpenContainer(w.containerFile, func(c *container) error {
+			for i, req := range batch {
+				results[i] = req.fn(c)
+			}
+			if err := c.sync(); err != nil {
+				return err
+			}
+			return commitLengths(c)
+		})
+		unlock()
+	}
+	if err != nil {
+		fmt.Println("write batch failed:", w.containerFile, err)
+	}
+	prometheus.WriteBatches.Inc()
+	for i, req := range batch {
+		if results[i] == nil {
+			results[i] = err
+		}
+		req.done <- results[i]
+	}
+}
@@ -0,0 +1,36 @@
+package shared
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentUpload(t *testing.T) {
+	memoryContainers(t)
+	test_uuid := GenerateTimeUUID()
+
+	// Uploads to one container are batched by its writer instead of failing on the lock
+	var wg sync.WaitGroup
+	errs := make([]error, 50)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id := test_uuid[:24] + fmt.Sprintf("%04x", i) + test_uuid[28:]
+			_, errs[i] = UploadVariant("", id, "", []byte("concurrent "+id))
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		id := test_uuid[:24] + fmt.Sprintf("%04x", i) + test_uuid[28:]
+		if err != nil {
+			t.Fatalf("Concurrent upload failed! Error:%v", err)
+		}
+		data, _, err := ReadBlob(id, "", "")
+		if err != nil || string(data) != "concurrent "+id {
+			t.Fatalf("Wrong content! Have:\"%v\" Error:%v", string(data), err)
+		}
+	}
+}
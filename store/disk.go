@@ -0,0 +1,232 @@
+package store
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/gofrs/flock"
+	"github.com/shirou/gopsutil/disk"
+)
+
+// Suffix of the lock files the Disk store keeps next to the containers
+const LOCK_SUFFIX = ".lock"
+
+// Disk keeps containers as tar files below Root, the working directory when empty.
+type Disk struct {
+	Root string
+}
+
+func (d *Disk) path(name string) string {
+	return filepath.Join(d.Root, name)
+}
+
+func (d *Disk) Put(name string, r io.Reader, size int64) error {
+	target := d.path(name)
+	if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(target+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.CopyN(f, r, size); err != nil {
+		os.Remove(target + ".tmp")
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		os.Remove(target + ".tmp")
+		return err
+	}
+	defer invalidateFile(target)
+	return os.Rename(target+".tmp", target)
+}
+
+func (d *Disk) Open(name string, offset int64, size int64) (io.ReadCloser, error) {
+	f, err := openCached(d.path(name), os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(f, offset, size), diskReader{f}}, nil
+}
+
+func (d *Disk) Delete(name string) error {
+	target := d.path(name)
+	defer invalidateFile(target)
+	err := os.Remove(target)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// diskReader reads a cached handle, which keeps a replaced or removed file readable.
+type diskReader struct {
+	*os.File
+}
+
+func (r diskReader) Size() int64 {
+	fi, err := r.Stat()
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+func (r diskReader) Close() error {
+	return releaseFile(r.File)
+}
+
+func (d *Disk) Reader(name string) (Reader, error) {
+	f, err := openCached(d.path(name), os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	return diskReader{f}, nil
+}
+
+func (d *Disk) Size(name string) (int64, error) {
+	fi, err := os.Stat(d.path(name))
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+func (d *Disk) Append(name string, write func(tw *tar.Writer) error) error {
+	target := d.path(name)
+	if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+		return err
+	}
+	f, err := openCached(target, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		return err
+	}
+	defer releaseFile(f)
+	return writeAtEnd(f, write)
+}
+
+// writeAtEnd positions f over the end-of-archive marker and appends the entries from write.
+func writeAtEnd(f *os.File, write func(tw *tar.Writer) error) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() > 0 {
+		if _, err = f.Seek(-2<<9, io.SeekEnd); err != nil {
+			fmt.Println(err)
+		}
+	} else {
+		if _, err = f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+
+	tw := tar.NewWriter(f)
+	if err := write(tw); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func (d *Disk) Sync(name string) error {
+	f, err := openCached(d.path(name), os.O_RDWR)
+	if err != nil {
+		return err
+	}
+	defer releaseFile(f)
+	return f.Sync()
+}
+
+// Rewrite writes the new container next to the old one and renames it over
+// it. Readers keep the replaced file open.
+func (d *Disk) Rewrite(name string, write func(tw *tar.Writer) error) error {
+	target := d.path(name)
+	tmpFile := target + ".tmp"
+	out, err := os.OpenFile(tmpFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	tw := tar.NewWriter(out)
+	if err := write(tw); err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	defer invalidateFile(target)
+	return os.Rename(tmpFile, target)
+}
+
+// ReadOnly drops the write permissions of the file, Rewrite and Delete still
+// replace it through its folder.
+func (d *Disk) ReadOnly(name string) error {
+	return os.Chmod(d.path(name), 0400)
+}
+
+func (d *Disk) List(folder string, fn func(name string) error) error {
+	root := d.Root
+	if root == "" {
+		root = "."
+	}
+	return filepath.WalkDir(d.path(folder), func(pathX string, infoX os.DirEntry, errX error) error {
+		if errX != nil {
+			if os.IsNotExist(errX) {
+				return filepath.SkipDir
+			}
+			return errX
+		}
+		if infoX.IsDir() || filepath.Ext(pathX) == ".tmp" || filepath.Ext(pathX) == LOCK_SUFFIX {
+			return nil
+		}
+		name, err := filepath.Rel(root, pathX)
+		if err != nil {
+			return err
+		}
+		return fn(filepath.ToSlash(name))
+	})
+}
+
+// Lock takes the flock of the lock file next to the container, which guards
+// all its segments. The container itself is not created.
+func (d *Disk) Lock(name string) (func(), error) {
+	target := d.path(name) + LOCK_SUFFIX
+	if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+		return nil, err
+	}
+	fileLock := flock.New(target)
+	if err := fileLock.Lock(); err != nil {
+		return nil, err
+	}
+	return func() { fileLock.Unlock() }, nil
+}
+
+// Usage returns the usage of the file system holding folder, or its closest
+// existing parent.
+func (d *Disk) Usage(folder string) (Usage, error) {
+	target := d.path(folder)
+	for {
+		if _, err := os.Stat(target); err == nil || filepath.Dir(target) == target {
+			break
+		}
+		target = filepath.Dir(target)
+	}
+	usageStat, err := disk.UsageWithContext(ctx, target)
+	if err != nil {
+		return Usage{}, err
+	}
+	return Usage{Total: usageStat.Total, Used: usageStat.Used, Free: usageStat.Free, UsedPercent: usageStat.UsedPercent}, nil
+}
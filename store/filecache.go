@@ -0,0 +1,133 @@
+package store
+
+import (
+	"container/list"
+	"glacier/config"
+	"glacier/prometheus"
+	"os"
+	"strconv"
+	"sync"
+)
+
+type fileKey struct {
+	path     string
+	writable bool
+}
+
+type cachedFile struct {
+	key     fileKey
+	file    *os.File
+	refs    int
+	element *list.Element // Position in the LRU list, nil once evicted
+}
+
+// Open container files kept for reuse, most recently used first. Handles
+// in use stay open until released, also when evicted or invalidated.
+var fileCache = struct {
+	sync.Mutex
+	lru    *list.List
+	byKey  map[fileKey]*cachedFile
+	byFile map[*os.File]*cachedFile
+}{lru: list.New(), byKey: make(map[fileKey]*cachedFile), byFile: make(map[*os.File]*cachedFile)}
+
+func fileCacheSize() int {
+	size, err := strconv.Atoi(config.Settings.Get(config.FILE_CACHE_SIZE))
+	if err != nil || size < 0 {
+		return 512
+	}
+	return size
+}
+
+// openCached returns an open handle of the file, shared with other users
+// of the same path and mode. The handle must be returned with releaseFile.
+func openCached(path string, flag int) (*os.File, error) {
+	key := fileKey{path: path, writable: flag&os.O_RDWR != 0}
+	fileCache.Lock()
+	defer fileCache.Unlock()
+	if cached, ok := fileCache.byKey[key]; ok {
+		prometheus.FileCacheHits.Inc()
+		cached.refs++
+		fileCache.lru.MoveToFront(cached.element)
+		return cached.file, nil
+	}
+	prometheus.FileCacheMisses.Inc()
+	f, err := os.OpenFile(path, flag, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	cached := &cachedFile{key: key, file: f, refs: 1}
+	cached.element = fileCache.lru.PushFront(cached)
+	fileCache.byKey[key] = cached
+	fileCache.byFile[f] = cached
+	prometheus.FileCacheOpen.Inc()
+	for size := fileCacheSize(); fileCache.lru.Len() > size; {
+		if !evictOldest() {
+			break
+		}
+	}
+	return f, nil
+}
+
+// releaseFile returns a handle from openCached, closing it when it was evicted.
+func releaseFile(f *os.File) error {
+	fileCache.Lock()
+	defer fileCache.Unlock()
+	cached, ok := fileCache.byFile[f]
+	if !ok {
+		return f.Close()
+	}
+	cached.refs--
+	if cached.refs == 0 && cached.element == nil {
+		return closeCached(cached)
+	}
+	for size := fileCacheSize(); fileCache.lru.Len() > size; {
+		if !evictOldest() {
+			break
+		}
+	}
+	return nil
+}
+
+// evictOldest drops the least recently used handle not in use.
+func evictOldest() bool {
+	for e := fileCache.lru.Back(); e != nil; e = e.Prev() {
+		cached := e.Value.(*cachedFile)
+		if cached.refs == 0 {
+			prometheus.FileCacheEvictions.Inc()
+			closeCached(cached)
+			return true
+		}
+	}
+	return false
+}
+
+func closeCached(cached *cachedFile) error {
+	if cached.element != nil {
+		fileCache.lru.Remove(cached.element)
+		cached.element = nil
+		delete(fileCache.byKey, cached.key)
+	}
+	delete(fileCache.byFile, cached.file)
+	prometheus.FileCacheOpen.Dec()
+	return cached.file.Close()
+}
+
+// invalidateFile drops the cached handles of a file removed or replaced on
+// disk, so the next open sees the current file.
+func invalidateFile(path string) {
+	fileCache.Lock()
+	defer fileCache.Unlock()
+	for _, writable := range []bool{false, true} {
+		cached, ok := fileCache.byKey[fileKey{path: path, writable: writable}]
+		if !ok {
+			continue
+		}
+		if cached.refs == 0 {
+			closeCached(cached)
+			continue
+		}
+		fileCache.lru.Remove(cached.element)
+		cached.element = nil
+		delete(fileCache.byKey, cached.key)
+	}
+}
@@ -0,0 +1,194 @@
+package store
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Memory keeps containers in memory, for tests. Every write replaces the
+// content of a container, so readers keep the content they opened.
+type Memory struct {
+	Capacity uint64 // Total bytes reported by Usage
+
+	mutex    sync.Mutex
+	files    map[string][]byte
+	locks    map[string]chan struct{}
+	readOnly map[string]bool
+}
+
+func NewMemory(capacity uint64) *Memory {
+	return &Memory{Capacity: capacity, files: make(map[string][]byte), locks: make(map[string]chan struct{}), readOnly: make(map[string]bool)}
+}
+
+func notExist(op string, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+}
+
+func (m *Memory) content(name string) ([]byte, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	data, ok := m.files[name]
+	return data, ok
+}
+
+func (m *Memory) Put(name string, r io.Reader, size int64) error {
+	data, err := ioutil.ReadAll(io.LimitReader(r, size))
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	m.files[name] = data
+	delete(m.readOnly, name)
+	m.mutex.Unlock()
+	return nil
+}
+
+func (m *Memory) Open(name string, offset int64, size int64) (io.ReadCloser, error) {
+	data, ok := m.content(name)
+	if !ok {
+		return nil, notExist("open", name)
+	}
+	return ioutil.NopCloser(io.NewSectionReader(bytes.NewReader(data), offset, size)), nil
+}
+
+func (m *Memory) Delete(name string) error {
+	m.mutex.Lock()
+	delete(m.files, name)
+	delete(m.readOnly, name)
+	m.mutex.Unlock()
+	return nil
+}
+
+type memoryReader struct {
+	*bytes.Reader
+}
+
+func (r memoryReader) Close() error {
+	return nil
+}
+
+func (m *Memory) Reader(name string) (Reader, error) {
+	data, ok := m.content(name)
+	if !ok {
+		return nil, notExist("open", name)
+	}
+	return memoryReader{bytes.NewReader(data)}, nil
+}
+
+func (m *Memory) Size(name string) (int64, error) {
+	data, ok := m.content(name)
+	if !ok {
+		return 0, notExist("stat", name)
+	}
+	return int64(len(data)), nil
+}
+
+// Append writes the entries to a buffer first, write may read other containers.
+func (m *Memory) Append(name string, write func(tw *tar.Writer) error) error {
+	var entries bytes.Buffer
+	tw := tar.NewWriter(&entries)
+	if err := write(tw); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.readOnly[name] {
+		return &os.PathError{Op: "append", Path: name, Err: os.ErrPermission}
+	}
+	old := m.files[name]
+	if len(old) >= 2<<9 {
+		old = old[:len(old)-2<<9]
+	}
+	data := make([]byte, 0, len(old)+entries.Len())
+	m.files[name] = append(append(data, old...), entries.Bytes()...)
+	return nil
+}
+
+func (m *Memory) Sync(name string) error {
+	if _, ok := m.content(name); !ok {
+		return notExist("sync", name)
+	}
+	return nil
+}
+
+func (m *Memory) Rewrite(name string, write func(tw *tar.Writer) error) error {
+	var entries bytes.Buffer
+	tw := tar.NewWriter(&entries)
+	if err := write(tw); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	m.files[name] = entries.Bytes()
+	delete(m.readOnly, name)
+	m.mutex.Unlock()
+	return nil
+}
+
+func (m *Memory) ReadOnly(name string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.files[name]; !ok {
+		return notExist("chmod", name)
+	}
+	m.readOnly[name] = true
+	return nil
+}
+
+func (m *Memory) List(folder string, fn func(name string) error) error {
+	m.mutex.Lock()
+	var names []string
+	for name := range m.files {
+		if strings.HasPrefix(name, strings.TrimSuffix(folder, "/")+"/") {
+			names = append(names, name)
+		}
+	}
+	m.mutex.Unlock()
+	sort.Strings(names)
+	for _, name := range names {
+		if err := fn(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Memory) Lock(name string) (func(), error) {
+	m.mutex.Lock()
+	lock, ok := m.locks[name]
+	if !ok {
+		lock = make(chan struct{}, 1)
+		m.locks[name] = lock
+	}
+	m.mutex.Unlock()
+	lock <- struct{}{}
+	return func() { <-lock }, nil
+}
+
+// Usage counts the bytes of all containers against Capacity.
+func (m *Memory) Usage(folder string) (Usage, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	usage := Usage{Total: m.Capacity}
+	for _, data := range m.files {
+		usage.Used += uint64(len(data))
+	}
+	if usage.Total > usage.Used {
+		usage.Free = usage.Total - usage.Used
+	}
+	if usage.Total > 0 {
+		usage.UsedPercent = float64(usage.Used) / float64(usage.Total) * 100
+	}
+	return usage, nil
+}
@@ -0,0 +1,86 @@
+package store
+
+import (
+	"context"
+	"glacier/config"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+var ctx = context.Background()
+
+// S3 keeps containers as objects in a bucket of an S3-compatible endpoint.
+type S3 struct {
+	client *minio.Client
+	bucket string
+	region string
+
+	mutex   sync.Mutex
+	created bool // The bucket exists
+}
+
+// NewS3 returns the store of the TIERING endpoint and bucket.
+func NewS3() (*S3, error) {
+	client, err := minio.New(config.Settings.Get(config.TIERING_ENDPOINT), &minio.Options{
+		Creds:  credentials.NewStaticV4(config.Settings.Get(config.TIERING_ACCESS_KEY), config.Settings.Get(config.TIERING_SECRET_KEY), ""),
+		Secure: config.Settings.Get(config.TIERING_SSL) == "true",
+		Region: config.Settings.Get(config.TIERING_REGION),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &S3{client: client, bucket: config.Settings.Get(config.TIERING_BUCKET), region: config.Settings.Get(config.TIERING_REGION)}, nil
+}
+
+// createBucket creates the bucket before the first object is stored.
+func (s *S3) createBucket() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.created {
+		return nil
+	}
+	exists, err := s.client.BucketExists(ctx, s.bucket)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		err := s.client.MakeBucket(ctx, s.bucket, minio.MakeBucketOptions{Region: s.region})
+		// Another server may have created it meanwhile
+		if err != nil && minio.ToErrorResponse(err).Code != "BucketAlreadyOwnedByYou" {
+			return err
+		}
+	}
+	s.created = true
+	return nil
+}
+
+func (s *S3) Put(name string, r io.Reader, size int64) error {
+	if err := s.createBucket(); err != nil {
+		return err
+	}
+	_, err := s.client.PutObject(ctx, s.bucket, name, r, size, minio.PutObjectOptions{
+		ContentType:          "application/x-tar",
+		DisableContentSha256: true,
+	})
+	return err
+}
+
+func (s *S3) Open(name string, offset int64, size int64) (io.ReadCloser, error) {
+	if size == 0 {
+		return ioutil.NopCloser(strings.NewReader("")), nil
+	}
+	opts := minio.GetObjectOptions{}
+	if err := opts.SetRange(offset, offset+size-1); err != nil {
+		return nil, err
+	}
+	return s.client.GetObject(ctx, s.bucket, name, opts)
+}
+
+func (s *S3) Delete(name string) error {
+	return s.client.RemoveObject(ctx, s.bucket, name, minio.RemoveObjectOptions{})
+}
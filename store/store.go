@@ -0,0 +1,106 @@
+package store
+
+import (
+	"archive/tar"
+	"errors"
+	"glacier/config"
+	"io"
+)
+
+// ColdStore keeps sealed containers, which are no longer written, addressed
+// by their container path.
+type ColdStore interface {
+	// Put stores size bytes from r as the container name
+	Put(name string, r io.Reader, size int64) error
+	// Open returns size bytes of the container name from offset
+	Open(name string, offset int64, size int64) (io.ReadCloser, error)
+	// Delete removes the container name
+	Delete(name string) error
+}
+
+// Store keeps the containers Glacier writes to, addressed by their container
+// path. Writes to a container are serialized by its lock.
+type Store interface {
+	ColdStore
+	// Reader opens the container name for reading its entries
+	Reader(name string) (Reader, error)
+	// Size returns the current length of the container name
+	Size(name string) (int64, error)
+	// Append writes the entries from write over the end-of-archive marker of
+	// the container name, creating it when missing
+	Append(name string, write func(tw *tar.Writer) error) error
+	// Sync commits the appended entries of the container name
+	Sync(name string) error
+	// Rewrite replaces the container name at once by the entries from write
+	Rewrite(name string, write func(tw *tar.Writer) error) error
+	// ReadOnly refuses appends to the container name until it is replaced
+	ReadOnly(name string) error
+	// List calls fn for the containers and markers below folder in name order,
+	// until fn returns an error
+	List(folder string, fn func(name string) error) error
+	// Lock waits for the write lock of the container name and returns its unlock
+	Lock(name string) (func(), error)
+	// Usage returns the space used on the storage holding folder
+	Usage(folder string) (Usage, error)
+}
+
+// Reader reads a container opened by Store.Reader. Entries already written
+// stay readable when the container is appended to, replaced or deleted.
+type Reader interface {
+	io.ReaderAt
+	io.Closer
+	// Size returns the length readable by ReadAt
+	Size() int64
+}
+
+type Usage struct {
+	Total       uint64
+	Used        uint64
+	Free        uint64
+	UsedPercent float64
+}
+
+// Values of STORAGE_BACKEND
+const (
+	BACKEND_LOCAL = "local"
+	BACKEND_S3    = "s3"
+	BACKEND_SWIFT = "swift"
+)
+
+// Backend returns STORAGE_BACKEND, s3 when only TIERING_ENDPOINT is set.
+func Backend() string {
+	backend := config.Settings.Get(config.STORAGE_BACKEND)
+	if backend == "" {
+		if config.Settings.Has(config.TIERING_ENDPOINT) {
+			return BACKEND_S3
+		}
+		return BACKEND_LOCAL
+	}
+	return backend
+}
+
+// NewCold returns the ColdStore of STORAGE_BACKEND.
+func NewCold() (ColdStore, error) {
+	switch Backend() {
+	case BACKEND_LOCAL:
+		return &Disk{Root: config.Settings.Get(config.STORAGE_LOCAL_ROOT)}, nil
+	case BACKEND_S3:
+		return NewS3()
+	case BACKEND_SWIFT:
+		return NewSwift(), nil
+	}
+	return nil, errors.New("unknown STORAGE_BACKEND " + Backend())
+}
+
+// New returns the Store of CONTAINER_BACKEND, the containers uploads are
+// written to and reads and autoclean go through.
+func New() (Store, error) {
+	backend := config.Settings.Get(config.CONTAINER_BACKEND)
+	switch backend {
+	case "", BACKEND_LOCAL:
+		return &Disk{}, nil
+	case BACKEND_SWIFT:
+		return NewSwift(), nil
+	}
+	return nil, errors.New("unknown CONTAINER_BACKEND " + backend)
+}
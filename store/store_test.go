@@ -0,0 +1,334 @@
+package store
+
+import (
+	"archive/tar"
+	"bytes"
+	"glacier/config"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testStore(t *testing.T, s ColdStore) {
+	data := []byte("0123456789 sealed container")
+	name := "files/2022/11/02/13/aa.tar"
+	if err := s.Put(name, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("Put failed! Error:%v", err)
+	}
+	content, err := s.Open(name, 11, 6)
+	if err != nil {
+		t.Fatalf("Open failed! Error:%v", err)
+	}
+	part, _ := ioutil.ReadAll(content)
+	content.Close()
+	if string(part) != "sealed" {
+		t.Fatalf("Wrong range! Have:\"%v\"", string(part))
+	}
+	if err := s.Delete(name); err != nil {
+		t.Fatalf("Delete failed! Error:%v", err)
+	}
+	if content, err := s.Open(name, 0, 1); err == nil {
+		content.Close()
+		t.Fatalf("Deleted container still readable")
+	}
+}
+
+// testContainers appends to, reads, rewrites and lists containers of s.
+func testContainers(t *testing.T, s Store) {
+	name := "files/2022/11/02/13/aa.tar"
+	for _, id := range []string{"first", "second"} {
+		err := s.Append(name, func(tw *tar.Writer) error {
+			if err := tw.WriteHeader(&tar.Header{Name: id, Size: int64(len(id))}); err != nil {
+				return err
+			}
+			_, err := tw.Write([]byte(id))
+			return err
+		})
+		if err != nil {
+			t.Fatalf("Append failed! Error:%v", err)
+		}
+	}
+	if err := s.Sync(name); err != nil {
+		t.Fatalf("Sync failed! Error:%v", err)
+	}
+	reader, err := s.Reader(name)
+	if err != nil {
+		t.Fatalf("Reader failed! Error:%v", err)
+	}
+	defer reader.Close()
+	if size, err := s.Size(name); err != nil || size != reader.Size() {
+		t.Errorf("Size Have:%v Want:%v Error:%v", size, reader.Size(), err)
+	}
+	names := readNames(t, reader)
+	if strings.Join(names, ",") != "first,second" {
+		t.Fatalf("Appended entries Have:%v", names)
+	}
+
+	// Readers keep the replaced content
+	err = s.Rewrite(name, func(tw *tar.Writer) error {
+		return tw.WriteHeader(&tar.Header{Name: "third"})
+	})
+	if err != nil {
+		t.Fatalf("Rewrite failed! Error:%v", err)
+	}
+	if names := readNames(t, reader); strings.Join(names, ",") != "first,second" {
+		t.Errorf("Replaced entries Have:%v", names)
+	}
+	rewritten, err := s.Reader(name)
+	if err != nil {
+		t.Fatalf("Reader failed! Error:%v", err)
+	}
+	defer rewritten.Close()
+	if names := readNames(t, rewritten); strings.Join(names, ",") != "third" {
+		t.Errorf("Rewritten entries Have:%v", names)
+	}
+
+	unlock, err := s.Lock(name)
+	if err != nil {
+		t.Fatalf("Lock failed! Error:%v", err)
+	}
+	locked := make(chan bool)
+	go func() {
+		unlockAgain, err := s.Lock(name)
+		if err == nil {
+			unlockAgain()
+		}
+		locked <- true
+	}()
+	select {
+	case <-locked:
+		t.Errorf("Container locked twice")
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlock()
+	<-locked
+
+	// Locking does not create the container, nor shows up in listings
+	fresh := "files/2022/11/02/14/cc.tar"
+	unlock, err = s.Lock(fresh)
+	if err != nil {
+		t.Fatalf("Lock failed! Error:%v", err)
+	}
+	unlock()
+	if _, err := s.Size(fresh); !os.IsNotExist(err) {
+		t.Errorf("Container created by Lock! Error:%v", err)
+	}
+
+	marker := "files/2022/11/02/14/bb.tar.compact"
+	if err := s.Put(marker, strings.NewReader(""), 0); err != nil {
+		t.Fatalf("Put failed! Error:%v", err)
+	}
+	var listed []string
+	err = s.List("files/2022/11", func(name string) error {
+		listed = append(listed, name)
+		return nil
+	})
+	if err != nil || strings.Join(listed, ",") != name+","+marker {
+		t.Errorf("List Have:%v Error:%v", listed, err)
+	}
+
+	if usage, err := s.Usage("files"); err != nil || usage.Total == 0 {
+		t.Errorf("Usage Have:%+v Error:%v", usage, err)
+	}
+	if err := s.Delete(name); err != nil {
+		t.Fatalf("Delete failed! Error:%v", err)
+	}
+	if _, err := s.Size(name); !os.IsNotExist(err) {
+		t.Errorf("Deleted container Error:%v", err)
+	}
+}
+
+func readNames(t *testing.T, reader Reader) []string {
+	var names []string
+	tr := tar.NewReader(io.NewSectionReader(reader, 0, reader.Size()))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return names
+		}
+		if err != nil {
+			t.Fatalf("Read entries failed! Error:%v", err)
+		}
+		names = append(names, hdr.Name)
+	}
+}
+
+func TestDisk(t *testing.T) {
+	testStore(t, &Disk{Root: t.TempDir()})
+	testContainers(t, &Disk{Root: t.TempDir()})
+
+	d := &Disk{Root: t.TempDir()}
+	name := "files/2022/11/02/13/aa.tar"
+	if err := d.Append(name, func(tw *tar.Writer) error { return nil }); err != nil {
+		t.Fatalf("Append failed! Error:%v", err)
+	}
+	if err := d.ReadOnly(name); err != nil {
+		t.Fatalf("ReadOnly failed! Error:%v", err)
+	}
+	fi, err := os.Stat(d.path(name))
+	if err != nil || fi.Mode().Perm()&0222 != 0 {
+		t.Fatalf("Container still writable! Have:%v Error:%v", fi, err)
+	}
+	// Rewrite replaces the read-only container by a writable one
+	if err := d.Rewrite(name, func(tw *tar.Writer) error { return nil }); err != nil {
+		t.Fatalf("Rewrite of read-only container failed! Error:%v", err)
+	}
+	fi, err = os.Stat(d.path(name))
+	if err != nil || fi.Mode().Perm()&0200 == 0 || fi.Mode().Perm()&0022 != 0 {
+		t.Fatalf("Wrong mode of the rewritten container! Have:%v Error:%v", fi, err)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	testStore(t, NewMemory(1<<30))
+	testContainers(t, NewMemory(1<<30))
+}
+
+func TestFileCache(t *testing.T) {
+	t.Cleanup(config.Settings.Override(config.FILE_CACHE_SIZE, "1"))
+	first := t.TempDir() + "/aa.tar"
+	second := t.TempDir() + "/bb.tar"
+
+	f, err := openCached(first, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		t.Fatalf("openCached error:%v", err)
+	}
+	again, _ := openCached(first, os.O_RDWR)
+	if again != f {
+		t.Errorf("Cached handle not reused")
+	}
+	releaseFile(again)
+	releaseFile(f)
+
+	g, err := openCached(second, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		t.Fatalf("openCached error:%v", err)
+	}
+	if _, err := f.Stat(); err == nil {
+		t.Errorf("Least recently used handle not closed")
+	}
+
+	// Invalidated handles in use are closed on release
+	invalidateFile(second)
+	if _, err := g.Stat(); err != nil {
+		t.Errorf("Handle in use closed by invalidation")
+	}
+	releaseFile(g)
+	if _, err := g.Stat(); err == nil {
+		t.Errorf("Invalidated handle not closed")
+	}
+}
+
+// testSwiftServer serves the Swift v1 API of the account test:tester.
+func testSwiftServer(t *testing.T) *httptest.Server {
+	var mutex sync.Mutex
+	objects := make(map[string][]byte)
+	readOnly := make(map[string]bool)
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if r.URL.Path == "/auth/v1.0" {
+			if r.Header.Get("X-Auth-User") != "test:tester" || r.Header.Get("X-Auth-Key") != "testing" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("X-Storage-Url", server.URL+"/v1/AUTH_test")
+			w.Header().Set("X-Auth-Token", "valid")
+			return
+		}
+		if r.Header.Get("X-Auth-Token") != "valid" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		path := strings.TrimPrefix(r.URL.Path, "/v1/AUTH_test")
+		container := strings.Count(path, "/") == 1
+		switch {
+		case r.Method == "PUT":
+			objects[path], _ = ioutil.ReadAll(r.Body)
+			delete(readOnly, path)
+			w.WriteHeader(http.StatusCreated)
+		case r.Method == "POST":
+			if _, ok := objects[path]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			readOnly[path] = r.Header.Get(SWIFT_READ_ONLY) == "true"
+			w.WriteHeader(http.StatusAccepted)
+		case container && r.Method == "HEAD":
+			used := 0
+			for name, object := range objects {
+				if strings.HasPrefix(name, path+"/") {
+					used += len(object)
+				}
+			}
+			w.Header().Set("X-Container-Bytes-Used", strconv.Itoa(used))
+			w.Header().Set(SWIFT_QUOTA, "1073741824")
+			w.WriteHeader(http.StatusNoContent)
+		case container && r.Method == "GET":
+			var names []string
+			for name := range objects {
+				name = strings.TrimPrefix(name, path+"/")
+				if strings.HasPrefix(name, r.URL.Query().Get("prefix")) && name > r.URL.Query().Get("marker") {
+					names = append(names, name)
+				}
+			}
+			sort.Strings(names)
+			// One name per page, to list through the markers
+			if len(names) > 1 {
+				names = names[:1]
+			}
+			for _, name := range names {
+				io.WriteString(w, name+"\n")
+			}
+		case r.Method == "GET" || r.Method == "HEAD":
+			object, ok := objects[path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if readOnly[path] {
+				w.Header().Set(SWIFT_READ_ONLY, "true")
+			}
+			http.ServeContent(w, r, "", time.Now(), bytes.NewReader(object))
+		case r.Method == "DELETE":
+			delete(objects, path)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestSwift(t *testing.T) {
+	server := testSwiftServer(t)
+	s := &Swift{authURL: server.URL + "/auth/v1.0", user: "test:tester", key: "testing", container: "glacier"}
+	testStore(t, s)
+	if !s.created {
+		t.Errorf("Swift container not created")
+	}
+
+	// An expired token is renewed
+	s.token = "expired"
+	testStore(t, s)
+
+	testContainers(t, s)
+	name := "files/2022/11/02/13/dd.tar"
+	if err := s.Append(name, func(tw *tar.Writer) error { return nil }); err != nil {
+		t.Fatalf("Append failed! Error:%v", err)
+	}
+	if err := s.ReadOnly(name); err != nil {
+		t.Fatalf("ReadOnly failed! Error:%v", err)
+	}
+	if err := s.Append(name, func(tw *tar.Writer) error { return nil }); !os.IsPermission(err) {
+		t.Fatalf("Append to read-only container! Error:%v", err)
+	}
+}
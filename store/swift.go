@@ -0,0 +1,373 @@
+package store
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"glacier/config"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Swift keeps containers as objects of an OpenStack Swift container, using
+// the v1 (TempAuth) authentication. Objects can not be appended to, every
+// write uploads the whole container again, and locks only hold within this
+// process, so one Glacier server uses the Swift container.
+type Swift struct {
+	authURL   string
+	user      string
+	key       string
+	container string
+
+	mutex      sync.Mutex
+	storageURL string
+	token      string
+	created    bool // The Swift container exists
+	locks      map[string]chan struct{}
+}
+
+func NewSwift() *Swift {
+	return &Swift{
+		authURL:   config.Settings.Get(config.SWIFT_AUTH_URL),
+		user:      config.Settings.Get(config.SWIFT_USER),
+		key:       config.Settings.Get(config.SWIFT_KEY),
+		container: config.Settings.Get(config.SWIFT_CONTAINER),
+	}
+}
+
+// authenticate returns the storage URL and token, requesting a new token when renew is set.
+func (s *Swift) authenticate(renew bool) (string, string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.token != "" && !renew {
+		return s.storageURL, s.token, nil
+	}
+	req, err := http.NewRequest("GET", s.authURL, nil)
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("X-Auth-User", s.user)
+	req.Header.Set("X-Auth-Key", s.key)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return "", "", errors.New("swift auth: " + resp.Status)
+	}
+	s.storageURL = strings.TrimRight(resp.Header.Get("X-Storage-Url"), "/")
+	s.token = resp.Header.Get("X-Auth-Token")
+	if s.storageURL == "" || s.token == "" {
+		return "", "", errors.New("swift auth: no storage url or token")
+	}
+	return s.storageURL, s.token, nil
+}
+
+func (s *Swift) objectPath(name string) string {
+	var parts []string
+	for _, part := range strings.Split(name, "/") {
+		parts = append(parts, url.PathEscape(part))
+	}
+	return "/" + url.PathEscape(s.container) + "/" + strings.Join(parts, "/")
+}
+
+// do sends the request to path below the storage URL, authenticating again
+// once when the token expired. body returns a fresh request body.
+func (s *Swift) do(method string, path string, header http.Header, body func() io.Reader) (*http.Response, error) {
+	for renew := false; ; renew = true {
+		storageURL, token, err := s.authenticate(renew)
+		if err != nil {
+			return nil, err
+		}
+		var reader io.Reader
+		if body != nil {
+			reader = body()
+		}
+		req, err := http.NewRequest(method, storageURL+path, reader)
+		if err != nil {
+			return nil, err
+		}
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		req.Header.Set("X-Auth-Token", token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusUnauthorized || renew {
+			return resp, nil
+		}
+		resp.Body.Close()
+	}
+}
+
+func (s *Swift) createContainer() error {
+	s.mutex.Lock()
+	created := s.created
+	s.mutex.Unlock()
+	if created {
+		return nil
+	}
+	resp, err := s.do("PUT", "/"+url.PathEscape(s.container), nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.New("swift container: " + resp.Status)
+	}
+	s.mutex.Lock()
+	s.created = true
+	s.mutex.Unlock()
+	return nil
+}
+
+// Put uploads the container in one request. The reader can not be sent
+// twice, so it is buffered to retry with a new token.
+func (s *Swift) Put(name string, r io.Reader, size int64) error {
+	data, err := ioutil.ReadAll(io.LimitReader(r, size))
+	if err != nil {
+		return err
+	}
+	return s.put(name, data)
+}
+
+// put replaces the object name by data, which also drops its read-only mark.
+func (s *Swift) put(name string, data []byte) error {
+	if err := s.createContainer(); err != nil {
+		return err
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/x-tar")
+	resp, err := s.do("PUT", s.objectPath(name), header, func() io.Reader { return bytes.NewReader(data) })
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("swift put %v: %v", name, resp.Status)
+	}
+	return nil
+}
+
+// get downloads the object name with its headers.
+func (s *Swift) get(name string) ([]byte, http.Header, error) {
+	resp, err := s.do("GET", s.objectPath(name), nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil, notExist("open", name)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("swift get %v: %v", name, resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	return data, resp.Header, err
+}
+
+func (s *Swift) Open(name string, offset int64, size int64) (io.ReadCloser, error) {
+	if size == 0 {
+		return ioutil.NopCloser(strings.NewReader("")), nil
+	}
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+size-1))
+	resp, err := s.do("GET", s.objectPath(name), header, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, fmt.Errorf("swift get %v: %v", name, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+func (s *Swift) Delete(name string) error {
+	resp, err := s.do("DELETE", s.objectPath(name), nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("swift delete %v: %v", name, resp.Status)
+	}
+	return nil
+}
+
+// Reader downloads the container, so readers keep the content they opened.
+func (s *Swift) Reader(name string) (Reader, error) {
+	data, _, err := s.get(name)
+	if err != nil {
+		return nil, err
+	}
+	return memoryReader{bytes.NewReader(data)}, nil
+}
+
+func (s *Swift) Size(name string) (int64, error) {
+	resp, err := s.do("HEAD", s.objectPath(name), nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return 0, notExist("stat", name)
+	}
+	if resp.StatusCode >= 300 {
+		return 0, fmt.Errorf("swift head %v: %v", name, resp.Status)
+	}
+	return strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+}
+
+// Append downloads the container and uploads it again with the entries
+// written over its end-of-archive marker.
+func (s *Swift) Append(name string, write func(tw *tar.Writer) error) error {
+	var entries bytes.Buffer
+	tw := tar.NewWriter(&entries)
+	if err := write(tw); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	old, header, err := s.get(name)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if header.Get(SWIFT_READ_ONLY) == "true" {
+		return &os.PathError{Op: "append", Path: name, Err: os.ErrPermission}
+	}
+	if len(old) >= 2<<9 {
+		old = old[:len(old)-2<<9]
+	}
+	return s.put(name, append(old, entries.Bytes()...))
+}
+
+// Sync has nothing to commit, the object is stored once its upload returned.
+func (s *Swift) Sync(name string) error {
+	_, err := s.Size(name)
+	return err
+}
+
+func (s *Swift) Rewrite(name string, write func(tw *tar.Writer) error) error {
+	var entries bytes.Buffer
+	tw := tar.NewWriter(&entries)
+	if err := write(tw); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return s.put(name, entries.Bytes())
+}
+
+// Metadata marking containers refused to Append, dropped by the next upload
+const SWIFT_READ_ONLY = "X-Object-Meta-Glacier-Read-Only"
+
+func (s *Swift) ReadOnly(name string) error {
+	header := http.Header{}
+	header.Set("Content-Type", "application/x-tar")
+	header.Set(SWIFT_READ_ONLY, "true")
+	resp, err := s.do("POST", s.objectPath(name), header, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return notExist("chmod", name)
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("swift post %v: %v", name, resp.Status)
+	}
+	return nil
+}
+
+// List pages through the object names below folder, Swift returns them sorted.
+func (s *Swift) List(folder string, fn func(name string) error) error {
+	query := url.Values{}
+	query.Set("prefix", strings.TrimSuffix(folder, "/")+"/")
+	query.Set("format", "plain")
+	for {
+		resp, err := s.do("GET", "/"+url.PathEscape(s.container)+"?"+query.Encode(), nil, nil)
+		if err != nil {
+			return err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("swift list %v: %v", folder, resp.Status)
+		}
+		names := strings.Fields(string(body))
+		if len(names) == 0 {
+			return nil
+		}
+		for _, name := range names {
+			if err := fn(name); err != nil {
+				return err
+			}
+		}
+		query.Set("marker", names[len(names)-1])
+	}
+}
+
+func (s *Swift) Lock(name string) (func(), error) {
+	s.mutex.Lock()
+	if s.locks == nil {
+		s.locks = make(map[string]chan struct{})
+	}
+	lock, ok := s.locks[name]
+	if !ok {
+		lock = make(chan struct{}, 1)
+		s.locks[name] = lock
+	}
+	s.mutex.Unlock()
+	lock <- struct{}{}
+	return func() { <-lock }, nil
+}
+
+// Metadata of the Swift container limiting its size, e.g. set with
+// swift post -m Quota-Bytes:<bytes>
+const SWIFT_QUOTA = "X-Container-Meta-Quota-Bytes"
+
+// Usage counts the bytes of the Swift container against its quota, without a
+// quota Total stays 0 and autoclean never deletes.
+func (s *Swift) Usage(folder string) (Usage, error) {
+	resp, err := s.do("HEAD", "/"+url.PathEscape(s.container), nil, nil)
+	if err != nil {
+		return Usage{}, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return Usage{}, nil
+	}
+	if resp.StatusCode >= 300 {
+		return Usage{}, fmt.Errorf("swift head %v: %v", s.container, resp.Status)
+	}
+	var usage Usage
+	usage.Used, _ = strconv.ParseUint(resp.Header.Get("X-Container-Bytes-Used"), 10, 64)
+	usage.Total, _ = strconv.ParseUint(resp.Header.Get(SWIFT_QUOTA), 10, 64)
+	if usage.Total > usage.Used {
+		usage.Free = usage.Total - usage.Used
+	}
+	if usage.Total > 0 {
+		usage.UsedPercent = float64(usage.Used) / float64(usage.Total) * 100
+	}
+	return usage, nil
+}